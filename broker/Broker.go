@@ -0,0 +1,370 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"github.com/adrianleh/WTMP-middleend/client"
+	"github.com/adrianleh/WTMP-middleend/command"
+	"github.com/adrianleh/WTMP-middleend/logging"
+	"github.com/adrianleh/WTMP-middleend/policy"
+	"github.com/adrianleh/WTMP-middleend/presence"
+	"github.com/adrianleh/WTMP-middleend/quota"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrBrokerClosed is returned by Serve once Shutdown has been called
+var ErrBrokerClosed = errors.New("broker closed")
+
+var (
+	connectionsAccepted = expvar.NewInt("connections_accepted")
+	framesReceived      = expvar.NewInt("frames_received")
+)
+
+type Broker struct {
+	clients        *client.ClientMap
+	env            *command.Env
+	maxMessageSize uint64
+	persistenceDir string
+	limits         quota.Limits
+	sessionExpiry  time.Duration
+	// Liveness detection, see WithHeartbeat
+	heartbeatInterval time.Duration
+	missedBeats       uint
+	deadClientPolicy  presence.DeadClientPolicy
+	heartbeatTicks    <-chan time.Time // Replaces the ticker every heartbeatInterval if set, for tests
+	presenceHandlers  []func(PresenceEvent)
+	stop              chan struct{} // Closed on Shutdown to stop background work
+	mutex             *sync.Mutex   // Guards shuttingDown, listeners and conns
+	shuttingDown      bool
+	listeners         map[net.Listener]bool
+	conns             map[net.Conn]bool
+	commands          *sync.WaitGroup
+}
+
+type Option func(*Broker)
+
+// WithMaxMessageSize Closes connections sending frames with more than size bytes of data, 0 meaning unbounded
+func WithMaxMessageSize(size uint64) Option {
+	return func(b *Broker) { b.maxMessageSize = size }
+}
+
+// WithMaxQueueLength Bounds the number of messages held per accepted type of each client, 0 meaning unbounded
+func WithMaxQueueLength(length uint64) Option {
+	return func(b *Broker) { b.clients.SetMaxQueueLength(length) }
+}
+
+// WithLimits Applies rate limits and resource quotas to all clients
+func WithLimits(limits quota.Limits) Option {
+	return func(b *Broker) {
+		b.limits = limits
+		b.clients.SetLimits(limits)
+	}
+}
+
+// WithSessionExpiry Removes resumable clients that have been disconnected for longer than expiry, 0 keeps them forever
+func WithSessionExpiry(expiry time.Duration) Option {
+	return func(b *Broker) {
+		b.sessionExpiry = expiry
+		b.clients.SetSessionExpiry(expiry)
+	}
+}
+
+// WithOutbound Lets up to queueLength messages wait for each client's callback socket and disconnects clients
+// not accepting a write within writeTimeout or falling behind further
+func WithOutbound(queueLength int, writeTimeout time.Duration) Option {
+	return func(b *Broker) { b.clients.SetOutbound(queueLength, writeTimeout) }
+}
+
+// WithPersistenceDir Restores the queues found in dir and persists all queues there on Shutdown
+func WithPersistenceDir(dir string) Option {
+	return func(b *Broker) { b.persistenceDir = dir }
+}
+
+// WithPayloadValidation Rejects sent messages that are not valid values of their type, e.g. bools other than 0 and 1
+func WithPayloadValidation(validate bool) Option {
+	return func(b *Broker) { b.env.ValidatePayloads = validate }
+}
+
+// WithPolicy Authorizes commands with p
+func WithPolicy(p *policy.Policy) Option {
+	return func(b *Broker) { b.env.Policy = p }
+}
+
+// WithHandler Serves commandId with handler, replacing the built-in handler if there is one
+func WithHandler(commandId uint8, handler command.Handler) Option {
+	return func(b *Broker) { b.env.Registry.Override(commandId, handler) }
+}
+
+// WithMiddleware Wraps every handler in middleware, inside the built-in logging, metrics, recovery and liveness
+// middleware
+func WithMiddleware(middleware ...command.Middleware) Option {
+	return func(b *Broker) { b.env.Registry.Use(middleware...) }
+}
+
+func New(opts ...Option) (*Broker, error) {
+	clients := client.CreateClientMap()
+	b := &Broker{
+		clients:          &clients,
+		env:              command.CreateEnv(&clients),
+		mutex:            &sync.Mutex{},
+		listeners:        map[net.Listener]bool{},
+		conns:            map[net.Conn]bool{},
+		commands:         &sync.WaitGroup{},
+		stop:             make(chan struct{}),
+		missedBeats:      3,
+		deadClientPolicy: presence.KeepDeadClients,
+	}
+	b.env.Done = b.stop
+	// Peers are authenticated before commands wait for their client, where peers can be told apart at all
+	b.env.AuthenticatePeers = client.PeerCredentialsSupported
+	b.env.Registry.Use(
+		command.LoggingMiddleware,
+		command.MetricsMiddleware,
+		command.RecoveryMiddleware,
+		command.LivenessMiddleware,
+	)
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.persistenceDir != "" {
+		if err := b.clients.LoadPersisted(b.persistenceDir); err != nil {
+			return nil, err
+		}
+	}
+	if b.sessionExpiry > 0 {
+		go b.expireSessions()
+	}
+	if b.heartbeatInterval > 0 {
+		go b.heartbeat()
+	}
+	return b, nil
+}
+
+func (b *Broker) expireSessions() {
+	ticker := time.NewTicker(b.sessionExpiry / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, cl := range b.clients.RemoveExpired() {
+				logging.Infof("Session of client %s expired", cl.Describe())
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+func (b *Broker) Clients() *client.ClientMap { return b.clients }
+
+// Stats Reports queue usage and quota violations of every registered client
+func (b *Broker) Stats() []client.Stats {
+	all := b.clients.All()
+	stats := make([]client.Stats, len(all))
+	for i, cl := range all {
+		stats[i] = cl.Stats()
+	}
+	return stats
+}
+
+// Registry Gives access to the command handlers, e.g. to register site-specific commands after construction
+func (b *Broker) Registry() *command.Registry { return b.env.Registry }
+
+// Serve Accepts connections on listener until Shutdown is called, always returning a non-nil error.
+// Serve may be called for several listeners concurrently.
+func (b *Broker) Serve(listener net.Listener) error {
+	if !b.trackListener(listener) {
+		listener.Close()
+		return ErrBrokerClosed
+	}
+	for {
+		fd, err := listener.Accept()
+		if err != nil {
+			if b.isShuttingDown() {
+				return ErrBrokerClosed
+			}
+			return err
+		}
+		if !b.track(fd) {
+			fd.Close()
+			return ErrBrokerClosed
+		}
+		connectionsAccepted.Add(1)
+		go b.server(fd)
+	}
+}
+
+func (b *Broker) server(conn net.Conn) {
+	defer b.untrack(conn)
+	peer, err := client.PeerOf(conn)
+	if err != nil {
+		logging.Debugf("Unknown peer: %v", err)
+	}
+	cmdConn := &command.Conn{Peer: peer, SendLimiter: quota.NewSendLimiter(b.limits)}
+	defer func() {
+		for _, id := range cmdConn.ClientIds() {
+			b.clients.Detach(id)
+		}
+	}()
+	for {
+		headerReader := io.LimitReader(conn, 25)
+		cmdFrameHeader, err := ioutil.ReadAll(headerReader)
+		if err != nil {
+			if !b.isShuttingDown() {
+				log.Println(err)
+			}
+			return
+		}
+		if len(cmdFrameHeader) == 0 {
+			return // Connection closed
+		}
+		if len(cmdFrameHeader) != 25 {
+			log.Printf("Size mistmatch header %d!", len(cmdFrameHeader))
+			continue
+		}
+		sizeRaw := cmdFrameHeader[16+1 : 25]
+		size := binary.BigEndian.Uint64(sizeRaw)
+		if b.maxMessageSize != 0 && size > b.maxMessageSize {
+			logging.Warnf("Frame of %d bytes exceeds max message size %d, closing connection", size, b.maxMessageSize)
+			return
+		}
+		dataReader := bufio.NewReaderSize(io.LimitReader(conn, int64(size)), 512)
+		data, err := ioutil.ReadAll(dataReader)
+		if uint64(len(data)) != size {
+			log.Printf("Size mistmatch data!")
+			continue
+		}
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		framesReceived.Add(1)
+		if !b.beginCommand() {
+			return
+		}
+		cmdFrame := append(cmdFrameHeader, data...)
+		err = b.env.Submit(cmdConn, cmdFrame)
+		b.commands.Done()
+		if err != nil {
+			log.Printf("Command failed: %v", err)
+		}
+	}
+}
+
+func (b *Broker) isShuttingDown() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.shuttingDown
+}
+
+func (b *Broker) trackListener(listener net.Listener) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.shuttingDown {
+		return false
+	}
+	b.listeners[listener] = true
+	return true
+}
+
+func (b *Broker) track(conn net.Conn) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.shuttingDown {
+		return false
+	}
+	b.conns[conn] = true
+	return true
+}
+
+func (b *Broker) untrack(conn net.Conn) {
+	b.mutex.Lock()
+	delete(b.conns, conn)
+	b.mutex.Unlock()
+	conn.Close()
+}
+
+// beginCommand Registers a command as in progress unless a shutdown has started
+func (b *Broker) beginCommand() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.shuttingDown {
+		return false
+	}
+	b.commands.Add(1)
+	return true
+}
+
+// Shutdown Stops accepting connections and frames, waits for the commands in progress,
+// notifies every registered client, flushes and closes their callback sockets and persists the queues
+// if a persistence directory is configured.
+// If ctx is done before all of that, Shutdown returns its error right away and skips the remaining steps.
+func (b *Broker) Shutdown(ctx context.Context) error {
+	b.mutex.Lock()
+	if !b.shuttingDown {
+		close(b.stop)
+	}
+	b.shuttingDown = true
+	for conn := range b.conns {
+		_ = conn.SetReadDeadline(time.Now()) // Wakes up connections waiting for their next frame
+	}
+	for listener := range b.listeners {
+		listener.Close()
+	}
+	b.mutex.Unlock()
+
+	if err := untilDone(ctx, func() error {
+		b.commands.Wait()
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	closed := &sync.WaitGroup{}
+	for _, cl := range b.clients.All() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := cl.Notify(client.ShutdownNotification, nil); err != nil {
+			logging.Warnf("Failed to notify client %s of shutdown: %v", cl.Describe(), err)
+		}
+		closed.Add(1)
+		go func(cl *client.Client) {
+			defer closed.Done()
+			cl.Close()
+		}(cl)
+	}
+	if err := untilDone(ctx, func() error {
+		closed.Wait()
+		return nil
+	}); err != nil {
+		return err
+	}
+	if b.persistenceDir != "" {
+		if err := untilDone(ctx, func() error { return b.clients.Persist(b.persistenceDir) }); err != nil {
+			return err
+		}
+		logging.Infof("Persisted queues to %s", b.persistenceDir)
+	}
+	return nil
+}
+
+// untilDone Runs step and returns its error, or ctx's error if ctx is done first. step keeps running in that case.
+func untilDone(ctx context.Context, step func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- step() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,751 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/adrianleh/WTMP-middleend/client"
+	"github.com/adrianleh/WTMP-middleend/command"
+	"github.com/adrianleh/WTMP-middleend/policy"
+	"github.com/adrianleh/WTMP-middleend/presence"
+	"github.com/adrianleh/WTMP-middleend/quota"
+	"github.com/adrianleh/WTMP-middleend/types"
+	"github.com/google/uuid"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testClient struct {
+	t        *testing.T
+	id       uuid.UUID
+	name     string
+	conn     net.Conn
+	callback net.Listener
+	cbPath   string
+	cbConn   net.Conn
+}
+
+func startBroker(t *testing.T, opts ...Option) (*Broker, string) {
+	b, err := New(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "broker.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go b.Serve(listener)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = b.Shutdown(ctx)
+	})
+	return b, path
+}
+
+func connect(t *testing.T, brokerPath string, name string) *testClient {
+	conn, err := net.Dial("unix", brokerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cbPath := filepath.Join(t.TempDir(), name+".sock")
+	callback, err := net.Listen("unix", cbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &testClient{t: t, id: uuid.New(), name: name, conn: conn, callback: callback, cbPath: cbPath}
+	t.Cleanup(func() {
+		conn.Close()
+		callback.Close()
+	})
+	return cl
+}
+
+func (cl *testClient) send(commandId uint8, data []byte) {
+	header := make([]byte, 25)
+	copy(header, cl.id[:])
+	header[16] = commandId
+	binary.BigEndian.PutUint64(header[17:25], uint64(len(data)))
+	if _, err := cl.conn.Write(append(header, data...)); err != nil {
+		cl.t.Fatal(err)
+	}
+}
+
+// read Reads exactly n bytes from the callback socket, accepting the broker's connection first if needed
+func (cl *testClient) read(n int) []byte {
+	if cl.cbConn == nil {
+		conn, err := cl.callback.Accept()
+		if err != nil {
+			cl.t.Fatal(err)
+		}
+		cl.cbConn = conn
+	}
+	_ = cl.cbConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(cl.cbConn, buf); err != nil {
+		cl.t.Fatal(err)
+	}
+	return buf
+}
+
+// receive Reads the next reply, which has to be n bytes long
+func (cl *testClient) receive(n int) []byte {
+	header := cl.read(5)
+	if header[0] != client.ReplyMarker {
+		cl.t.Fatalf("Expected a reply, got %v", header)
+	}
+	if length := binary.BigEndian.Uint32(header[1:5]); length != uint32(n) {
+		cl.t.Fatalf("Expected a reply of %d bytes, got %d", n, length)
+	}
+	return cl.read(n)
+}
+
+// receiveNotification Reads the next notification and returns its kind and payload
+func (cl *testClient) receiveNotification() (byte, []byte) {
+	header := cl.read(6)
+	if header[0] != client.NotificationMarker {
+		cl.t.Fatalf("Expected a notification, got %v", header)
+	}
+	return header[1], cl.read(int(binary.BigEndian.Uint32(header[2:6])))
+}
+
+func (cl *testClient) register() {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(len(cl.name)))
+	data = append(append(data, cl.name...), cl.cbPath...)
+	cl.send(command.RegisterCommandId, data)
+	if resp := cl.receive(1); resp[0] != 0 {
+		cl.t.Fatalf("Register of %s failed", cl.name)
+	}
+}
+
+func (cl *testClient) acceptType(typ types.Type) {
+	cl.send(command.AcceptTypeCommandId, typ.Serialize())
+	if resp := cl.receive(1); resp[0] != 0 {
+		cl.t.Fatalf("AcceptType %s failed", typ.Name())
+	}
+}
+
+func sendData(target string, typ types.Type, msg []byte) []byte {
+	typSer := typ.Serialize()
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(target)))
+	binary.BigEndian.PutUint32(data[4:8], uint32(len(typSer)))
+	return append(append(append(data, target...), typSer...), msg...)
+}
+
+func (cl *testClient) sendTo(target string, typ types.Type, msg []byte) {
+	cl.send(command.SendCommandId, sendData(target, typ, msg))
+}
+
+func (cl *testClient) getAny(timeout uint32, typs ...types.Type) {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data[0:4], timeout)
+	binary.BigEndian.PutUint32(data[4:8], uint32(len(typs)))
+	for _, typ := range typs {
+		data = append(data, typ.Serialize()...)
+	}
+	cl.send(command.GetAnyCommandId, data)
+}
+
+func TestTwoBrokers(t *testing.T) {
+	first, firstPath := startBroker(t)
+	second, secondPath := startBroker(t)
+
+	alice := connect(t, firstPath, "alice")
+	alice.register()
+	alice.acceptType(types.Int32Type{})
+	alice.sendTo("alice", types.Int32Type{}, []byte{0, 0, 0, 42})
+	alice.send(command.GetCommandId, types.Int32Type{}.Serialize())
+	if msg := alice.receive(4); !bytes.Equal(msg, []byte{0, 0, 0, 42}) {
+		t.Errorf("Wrong message %v", msg)
+	}
+
+	aliceTwin := connect(t, secondPath, "alice")
+	aliceTwin.register() // Same name is fine on another broker
+
+	if first.Clients().GetByName("alice") == nil || second.Clients().GetByName("alice") == nil {
+		t.Error("Both brokers should know alice")
+	}
+	if first.Clients().GetById(aliceTwin.id) != nil {
+		t.Error("Brokers should not share clients")
+	}
+	if peer := first.Clients().GetByName("alice").GetPeer(); peer == nil || peer.Pid != int32(os.Getpid()) {
+		t.Errorf("Registration should be bound to this process, got %s", peer)
+	}
+}
+
+func TestShutdownNotifies(t *testing.T) {
+	b, path := startBroker(t)
+	alice := connect(t, path, "alice")
+	alice.register()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := b.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if kind, _ := alice.receiveNotification(); kind != client.ShutdownNotification {
+		t.Errorf("Expected shutdown notification, got %d", kind)
+	}
+	if _, err := net.Dial("unix", path); err == nil {
+		t.Error("Should not accept after shutdown")
+	}
+}
+
+func TestShutdownStopsWhenContextDone(t *testing.T) {
+	dir := t.TempDir()
+	b, path := startBroker(t, WithPersistenceDir(dir))
+	alice := connect(t, path, "alice")
+	alice.register()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.Shutdown(ctx); err != context.Canceled {
+		t.Fatalf("Expected shutdown to be cancelled, got %v", err)
+	}
+	if persisted, _ := filepath.Glob(filepath.Join(dir, "*")); len(persisted) != 0 {
+		t.Errorf("Expected a cancelled shutdown not to persist, got %v", persisted)
+	}
+}
+
+func TestPolicyDeniesSend(t *testing.T) {
+	p, err := policy.Parse([]byte(`{"send": [{"senders": ["alice"], "types": ["Int32"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetAuditLog(ioutil.Discard)
+	_, path := startBroker(t, WithPolicy(p))
+	alice := connect(t, path, "alice")
+	alice.register()
+	alice.acceptType(types.Int64Type{})
+	alice.sendTo("alice", types.Int64Type{}, make([]byte, 8))
+	if kind, _ := alice.receiveNotification(); kind != client.DeniedNotification {
+		t.Errorf("Expected denial, got %d", kind)
+	}
+}
+
+func TestBatchReportsDenialOnce(t *testing.T) {
+	p, err := policy.Parse([]byte(`{"send": [{"senders": ["alice"], "types": ["Int32"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetAuditLog(ioutil.Discard)
+	_, path := startBroker(t, WithPolicy(p))
+	alice := connect(t, path, "alice")
+	alice.register()
+	alice.acceptType(types.Int64Type{})
+	item := sendData("alice", types.Int64Type{}, make([]byte, 8))
+	alice.send(command.SendBatchCommandId, append([]byte{0, 0, 0, 1, 0, 0, 0, byte(len(item))}, item...))
+	// A notification ahead of the results would fail receive
+	if resp := alice.receive(5); resp[4] != command.BatchItemDenied {
+		t.Errorf("Expected the item to be denied, got %v", resp)
+	}
+}
+
+func TestPolicyDeniesRegisterAndAcceptType(t *testing.T) {
+	p, err := policy.Parse([]byte(`{"register": [{"names": ["alice"]}],
+		"accept_type": [{"clients": ["alice"], "types": ["Int32"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetAuditLog(ioutil.Discard)
+	_, path := startBroker(t, WithPolicy(p))
+	alice := connect(t, path, "alice")
+	alice.register()
+	alice.send(command.AcceptTypeCommandId, types.Int64Type{}.Serialize())
+	if kind, _ := alice.receiveNotification(); kind != client.DeniedNotification {
+		t.Errorf("Expected the denied AcceptType to be notified, got %d", kind)
+	}
+	if resp := alice.receive(1); resp[0] != 1 {
+		t.Errorf("Expected AcceptType to fail, got %v", resp)
+	}
+
+	mallory := connect(t, path, "mallory")
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(len(mallory.name)))
+	mallory.send(command.RegisterCommandId, append(append(data, mallory.name...), mallory.cbPath...))
+	if kind, _ := mallory.receiveNotification(); kind != client.DeniedNotification {
+		t.Errorf("Expected the denied Register to be notified, got %d", kind)
+	}
+	if resp := mallory.receive(1); resp[0] != 1 {
+		t.Errorf("Expected Register to fail, got %v", resp)
+	}
+}
+
+func TestRepliesFramedApartFromNotifications(t *testing.T) {
+	p, err := policy.Parse([]byte(`{"send": [{"senders": ["alice"], "types": ["Int32"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetAuditLog(ioutil.Discard)
+	_, path := startBroker(t, WithPolicy(p))
+	alice := connect(t, path, "alice")
+	alice.register()
+	alice.acceptType(types.Int32Type{})
+	alice.acceptType(types.Int64Type{})
+	alice.sendTo("alice", types.Int64Type{}, make([]byte, 8))
+	alice.sendTo("alice", types.Int32Type{}, []byte{0xFF, 1, 0, 0})
+	alice.send(command.GetCommandId, types.Int32Type{}.Serialize())
+	if kind, _ := alice.receiveNotification(); kind != client.DeniedNotification {
+		t.Errorf("Expected denial, got %d", kind)
+	}
+	if msg := alice.receive(4); !bytes.Equal(msg, []byte{0xFF, 1, 0, 0}) {
+		t.Errorf("Message starting like a notification should arrive as a reply, got %v", msg)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	b, path := startBroker(t, WithLimits(quota.Limits{MessagesPerSecond: 1, MaxAcceptedTypes: 1, MaxClients: 1}))
+	alice := connect(t, path, "alice")
+	alice.register()
+	alice.acceptType(types.Int32Type{})
+	alice.send(command.AcceptTypeCommandId, types.Int64Type{}.Serialize())
+	if kind, _ := alice.receiveNotification(); kind != client.QuotaNotification {
+		t.Errorf("Expected quota notification for the second type, got %d", kind)
+	}
+	if resp := alice.receive(1); resp[0] != 1 {
+		t.Error("Second type should exceed max accepted types")
+	}
+
+	bob := connect(t, path, "bob")
+	bob.send(command.RegisterCommandId, append([]byte{0, 0, 0, 3}, "bob"+bob.cbPath...))
+	if kind, _ := bob.receiveNotification(); kind != client.QuotaNotification {
+		t.Errorf("Expected quota notification for the second client, got %d", kind)
+	}
+	if resp := bob.receive(1); resp[0] != 1 {
+		t.Error("Second client should exceed max clients")
+	}
+
+	alice.sendTo("alice", types.Int32Type{}, []byte{0, 0, 0, 1})
+	alice.sendTo("alice", types.Int32Type{}, []byte{0, 0, 0, 2})
+	if kind, _ := alice.receiveNotification(); kind != client.QuotaNotification {
+		t.Errorf("Expected quota notification, got %d", kind)
+	}
+	stats := b.Stats()
+	if len(stats) != 1 || stats[0].QueuedMessages != 1 || stats[0].QuotaViolations != 2 {
+		t.Errorf("Wrong stats %+v", stats)
+	}
+}
+
+func (cl *testClient) registerResumable() []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(len(cl.name)))
+	data = append(append(data, cl.name...), cl.cbPath...)
+	cl.send(command.RegisterResumableCommandId, data)
+	resp := cl.receive(17)
+	if resp[0] != 0 {
+		cl.t.Fatalf("Register of %s failed", cl.name)
+	}
+	return resp[1:]
+}
+
+func TestResumeSession(t *testing.T) {
+	b, path := startBroker(t, WithSessionExpiry(time.Minute))
+	alice := connect(t, path, "alice")
+	token := alice.registerResumable()
+	alice.acceptType(types.Int32Type{})
+	alice.sendTo("alice", types.Int32Type{}, []byte{0, 0, 0, 7})
+
+	attached := connect(t, path, "alice-impostor")
+	attached.send(command.ResumeCommandId, append(append([]byte{}, token...), attached.cbPath...))
+	if resp := attached.receive(1); resp[0] != 1 {
+		t.Error("Resuming a session still in use should fail")
+	}
+
+	alice.conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for !b.Clients().Detached(alice.id) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	restarted := connect(t, path, "alice-restarted")
+	restarted.send(command.ResumeCommandId, append(append([]byte{}, token...), restarted.cbPath...))
+	if resp := restarted.receive(1); resp[0] != 0 {
+		t.Fatal("Resume failed")
+	}
+	restarted.send(command.GetCommandId, types.Int32Type{}.Serialize())
+	if msg := restarted.receive(4); !bytes.Equal(msg, []byte{0, 0, 0, 7}) {
+		t.Errorf("Wrong message %v", msg)
+	}
+	if cl := b.Clients().GetByName("alice"); cl == nil || cl.GetId() != restarted.id {
+		t.Error("Name should now belong to the resumed client")
+	}
+	if b.Clients().GetById(alice.id) != nil {
+		t.Error("Old id should be gone")
+	}
+}
+
+func TestResumeWithSameId(t *testing.T) {
+	b, path := startBroker(t, WithSessionExpiry(time.Minute))
+	alice := connect(t, path, "alice")
+	token := alice.registerResumable()
+	alice.conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for !b.Clients().Detached(alice.id) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	restarted := connect(t, path, "alice-restarted")
+	restarted.id = alice.id
+	restarted.send(command.ResumeCommandId, append(append([]byte{}, token...), restarted.cbPath...))
+	if resp := restarted.receive(1); resp[0] != 0 {
+		t.Fatal("Resuming with the session's own id failed")
+	}
+	if cl := b.Clients().GetByName("alice"); cl == nil || cl.GetId() != alice.id {
+		t.Error("Name should still belong to the resumed client")
+	}
+}
+
+func TestSessionExpires(t *testing.T) {
+	b, path := startBroker(t, WithSessionExpiry(50*time.Millisecond))
+	alice := connect(t, path, "alice")
+	token := alice.registerResumable()
+	alice.conn.Close()
+	time.Sleep(200 * time.Millisecond)
+	if b.Clients().GetByName("alice") != nil {
+		t.Error("Expired session should be removed")
+	}
+	restarted := connect(t, path, "alice-restarted")
+	restarted.send(command.ResumeCommandId, append(append([]byte{}, token...), restarted.cbPath...))
+	if resp := restarted.receive(1); resp[0] != 1 {
+		t.Error("Resuming an expired session should fail")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	const interval = time.Hour // Time passes through ticks only
+	events := make(chan PresenceEvent, 10)
+	ticks := make(chan time.Time)
+	b, path := startBroker(t,
+		WithHeartbeat(interval, 3),
+		WithDeadClientPolicy(presence.RemoveDeadClients),
+		WithPresenceHandler(func(event PresenceEvent) { events <- event }),
+		func(b *Broker) { b.heartbeatTicks = ticks },
+	)
+	alice := connect(t, path, "alice")
+	alice.register()
+
+	tick := func(sinceLastSeen time.Duration, liveness client.Liveness) {
+		ticks <- time.Now().Add(sinceLastSeen)
+		select {
+		case event := <-events:
+			if event.Name != "alice" || event.Liveness != liveness {
+				t.Errorf("Expected alice to be %s, got %+v", liveness, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No presence event for %s", liveness)
+		}
+	}
+	tick(interval*3/2, client.Suspect)
+	if kind, _ := alice.receiveNotification(); kind != client.PingNotification {
+		t.Fatalf("Expected a ping, got %d", kind)
+	}
+	alice.send(command.PingCommandId, nil)
+	alice.receive(1)
+	tick(interval/2, client.Alive)
+	tick(interval*3/2, client.Suspect)
+	tick(interval*7/2, client.Dead)
+	ticks <- time.Now() // Taken once the dead client was cleaned up
+	if b.Clients().GetByName("alice") != nil {
+		t.Error("Dead client should be removed")
+	}
+}
+
+func TestGetAny(t *testing.T) {
+	_, path := startBroker(t)
+	alice := connect(t, path, "alice")
+	alice.register()
+	alice.acceptType(types.Int32Type{})
+	alice.acceptType(types.BoolType{})
+	alice.sendTo("alice", types.BoolType{}, []byte{1})
+	alice.sendTo("alice", types.Int32Type{}, []byte{0, 0, 0, 2})
+
+	alice.getAny(0)
+	if resp := alice.receive(1 + 5 + 1); resp[0] != 0 || !bytes.Equal(resp[1:], append(types.BoolType{}.Serialize(), 1)) {
+		t.Errorf("Expected the bool first, got %v", resp)
+	}
+	alice.getAny(0, types.BoolType{})
+	if resp := alice.receive(1); resp[0] != 1 {
+		t.Errorf("Expected no message, got %v", resp)
+	}
+
+	bob := connect(t, path, "bob")
+	bob.register()
+	bob.acceptType(types.Int64Type{})
+	bob.getAny(2000) // Whether it waits or not, it has to return the message
+	alice.sendTo("bob", types.Int64Type{}, []byte{0, 0, 0, 0, 0, 0, 0, 9})
+	if resp := bob.receive(1 + 5 + 8); resp[0] != 0 || resp[13] != 9 {
+		t.Errorf("Blocking get should return the sent message, got %v", resp)
+	}
+}
+
+func TestBatches(t *testing.T) {
+	_, path := startBroker(t)
+	alice := connect(t, path, "alice")
+	alice.register()
+	alice.acceptType(types.Int32Type{})
+
+	items := [][]byte{
+		sendData("alice", types.Int32Type{}, []byte{0, 0, 0, 1}),
+		sendData("nobody", types.Int32Type{}, []byte{0, 0, 0, 2}),
+		sendData("alice", types.Int32Type{}, []byte{0, 0, 0, 3}),
+	}
+	data := []byte{0, 0, 0, byte(len(items))}
+	for _, item := range items {
+		data = append(append(data, 0, 0, 0, byte(len(item))), item...)
+	}
+	alice.send(command.SendBatchCommandId, data)
+	expected := []byte{0, 0, 0, 3, command.BatchItemSent, command.BatchItemFailed, command.BatchItemSent}
+	if resp := alice.receive(len(expected)); !bytes.Equal(resp, expected) {
+		t.Errorf("Expected results %v, got %v", expected, resp)
+	}
+
+	alice.send(command.GetBatchCommandId, append([]byte{0, 0, 0, 10}, types.Int32Type{}.Serialize()...))
+	expected = []byte{0, 0, 0, 2, 0, 0, 0, 4, 0, 0, 0, 1, 0, 0, 0, 4, 0, 0, 0, 3}
+	if resp := alice.receive(len(expected)); !bytes.Equal(resp, expected) {
+		t.Errorf("Expected messages %v, got %v", expected, resp)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	_, path := startBroker(t, WithMaxQueueLength(2))
+	alice := connect(t, path, "alice")
+	alice.register()
+	alice.acceptType(types.Int32Type{})
+	bob := connect(t, path, "bob")
+	bob.register()
+	bob.acceptType(types.Int32Type{})
+
+	transaction := func(items ...[]byte) []byte {
+		data := []byte{0, 0, 0, byte(len(items))}
+		for _, item := range items {
+			data = append(append(data, 0, 0, 0, byte(len(item))), item...)
+		}
+		alice.send(command.SendTransactionCommandId, data)
+		return alice.receive(4 + len(items))[4:]
+	}
+	isEmpty := func(cl *testClient) bool {
+		cl.send(command.EmptyCommandId, types.Int32Type{}.Serialize())
+		return cl.receive(1)[0] == 1
+	}
+
+	results := transaction(
+		sendData("alice", types.Int32Type{}, []byte{0, 0, 0, 1}),
+		sendData("bob", types.Int64Type{}, make([]byte, 8)),
+	)
+	if !bytes.Equal(results, []byte{command.BatchItemAborted, command.BatchItemFailed}) {
+		t.Errorf("Expected the transaction to abort, got %v", results)
+	}
+	if !isEmpty(alice) {
+		t.Error("Aborted transaction must not deliver anything")
+	}
+
+	results = transaction(
+		sendData("alice", types.Int32Type{}, []byte{0, 0, 0, 1}),
+		sendData("bob", types.Int32Type{}, []byte{0, 0, 0, 2}),
+		sendData("bob", types.Int32Type{}, []byte{0, 0, 0, 3}),
+		sendData("bob", types.Int32Type{}, []byte{0, 0, 0, 4}),
+	)
+	if !bytes.Equal(results, bytes.Repeat([]byte{command.BatchItemFailed}, 4)) {
+		t.Errorf("Expected bob's queue to overflow, got %v", results)
+	}
+	if !isEmpty(alice) || !isEmpty(bob) {
+		t.Error("Overflowing transaction must not deliver anything")
+	}
+
+	results = transaction(
+		sendData("alice", types.Int32Type{}, []byte{0, 0, 0, 1}),
+		sendData("bob", types.Int32Type{}, []byte{0, 0, 0, 2}),
+	)
+	if !bytes.Equal(results, []byte{command.BatchItemSent, command.BatchItemSent}) {
+		t.Errorf("Expected the transaction to commit, got %v", results)
+	}
+	if isEmpty(alice) || isEmpty(bob) {
+		t.Error("Committed transaction should deliver to both")
+	}
+}
+
+func TestAbortedTransactionKeepsQuota(t *testing.T) {
+	_, path := startBroker(t, WithLimits(quota.Limits{MessagesPerSecond: 2}))
+	alice := connect(t, path, "alice")
+	alice.register()
+	alice.acceptType(types.Int32Type{})
+	transaction := func(items ...[]byte) []byte {
+		data := []byte{0, 0, 0, byte(len(items))}
+		for _, item := range items {
+			data = append(append(data, 0, 0, 0, byte(len(item))), item...)
+		}
+		alice.send(command.SendTransactionCommandId, data)
+		return alice.receive(4 + len(items))[4:]
+	}
+
+	valid := sendData("alice", types.Int32Type{}, []byte{0, 0, 0, 1})
+	results := transaction(valid, sendData("alice", types.Int64Type{}, make([]byte, 8)))
+	if !bytes.Equal(results, []byte{command.BatchItemAborted, command.BatchItemFailed}) {
+		t.Fatalf("Expected the transaction to abort, got %v", results)
+	}
+	if results := transaction(valid, valid); !bytes.Equal(results, []byte{command.BatchItemSent, command.BatchItemSent}) {
+		t.Errorf("Expected the aborted transaction to leave the quota alone, got %v", results)
+	}
+	if results := transaction(valid); !bytes.Equal(results, []byte{command.BatchItemOverQuota}) {
+		t.Errorf("Expected the committed transaction to use up the quota, got %v", results)
+	}
+}
+
+func TestTypeReference(t *testing.T) {
+	_, path := startBroker(t)
+	alice := connect(t, path, "alice")
+	alice.register()
+	typ := types.StructType{Fields: []types.Type{types.Int32Type{}, types.CharType{}}}
+	alice.acceptType(typ)
+	alice.sendTo("alice", typ, []byte{0, 0, 0, 5, 0, 6})
+	alice.send(command.GetCommandId, types.Reference(typ))
+	if msg := alice.receive(6); !bytes.Equal(msg, []byte{0, 0, 0, 5, 0, 6}) {
+		t.Errorf("Wrong message %v", msg)
+	}
+}
+
+func TestPayloadValidation(t *testing.T) {
+	_, path := startBroker(t, WithPayloadValidation(true))
+	alice := connect(t, path, "alice")
+	alice.register()
+	alice.acceptType(types.BoolType{})
+	alice.sendTo("alice", types.BoolType{}, []byte{2})
+	alice.sendTo("alice", types.BoolType{}, []byte{1})
+	alice.send(command.GetCommandId, types.BoolType{}.Serialize())
+	if msg := alice.receive(1); msg[0] != 1 {
+		t.Errorf("Invalid bool should have been rejected, got %v", msg)
+	}
+}
+
+func TestVariableSizeMessages(t *testing.T) {
+	_, path := startBroker(t)
+	alice := connect(t, path, "alice")
+	alice.register()
+	logLine := types.StructType{Fields: []types.Type{types.StringType{}}}
+	alice.acceptType(logLine)
+
+	tagged := types.StructType{Fields: []types.Type{types.StringType{}, types.Int32Type{}}}
+	alice.sendTo("alice", tagged, []byte{0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o', 0, 0, 0, 1})
+	alice.sendTo("alice", logLine, []byte{0, 0, 0, 2, 'h', 'i'})
+	alice.sendTo("alice", logLine, []byte{0, 0, 0, 9, 't', 'r', 'u', 'n', 'c'})
+
+	alice.send(command.GetCommandId, logLine.Serialize())
+	if msg := alice.receive(9); !bytes.Equal(msg, []byte{0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o'}) {
+		t.Errorf("Expected the trimmed subtype message, got %v", msg)
+	}
+	alice.send(command.GetCommandId, logLine.Serialize())
+	if msg := alice.receive(6); !bytes.Equal(msg, []byte{0, 0, 0, 2, 'h', 'i'}) {
+		t.Errorf("Wrong message %v", msg)
+	}
+	alice.send(command.EmptyCommandId, logLine.Serialize())
+	if resp := alice.receive(1); resp[0] != 1 {
+		t.Error("Truncated message should have been rejected")
+	}
+}
+
+func TestTaggedUnion(t *testing.T) {
+	_, path := startBroker(t)
+	alice := connect(t, path, "alice")
+	alice.register()
+	point := types.StructType{Fields: []types.Type{types.Int32Type{}, types.Int32Type{}}}
+	shape := types.TaggedUnionType{Members: []types.Type{types.CharType{}, point}}
+	alice.acceptType(shape)
+
+	alice.sendTo("alice", shape, []byte{0, 0, 0, 0, 0, 'a'})
+	alice.sendTo("alice", types.StructType{Fields: []types.Type{types.Int32Type{}, types.Int32Type{}, types.BoolType{}}},
+		[]byte{0, 0, 0, 1, 0, 0, 0, 2, 1})
+	alice.sendTo("alice", shape, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 1}) // Tagged char with a point's payload
+
+	alice.send(command.GetCommandId, shape.Serialize())
+	if msg := alice.receive(6); !bytes.Equal(msg, []byte{0, 0, 0, 0, 0, 'a'}) {
+		t.Errorf("Wrong message %v", msg)
+	}
+	alice.send(command.GetCommandId, shape.Serialize())
+	if msg := alice.receive(12); !bytes.Equal(msg, []byte{0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 2}) {
+		t.Errorf("Expected the subtype to be wrapped as a point, got %v", msg)
+	}
+	alice.send(command.EmptyCommandId, shape.Serialize())
+	if resp := alice.receive(1); resp[0] != 1 {
+		t.Error("Payload not matching its tag should have been rejected")
+	}
+}
+
+func TestWidening(t *testing.T) {
+	_, path := startBroker(t)
+	alice := connect(t, path, "alice")
+	alice.register()
+	wide := types.StructType{Fields: []types.Type{types.Int64Type{}, types.Float64Type{}}}
+	narrow := types.StructType{Fields: []types.Type{types.Int32Type{}, types.Float32Type{}, types.BoolType{}}}
+	alice.acceptType(types.Int64Type{})
+	alice.send(command.AcceptTypeCommandId, append(wide.Serialize(), command.AcceptWidening))
+	if resp := alice.receive(1); resp[0] != 0 {
+		t.Fatal("AcceptType with widening failed")
+	}
+
+	alice.sendTo("alice", narrow, []byte{0xFF, 0xFF, 0xFF, 0xFE, 0x3F, 0xC0, 0, 0, 1})
+	alice.send(command.GetCommandId, wide.Serialize())
+	expected := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFE, 0x3F, 0xF8, 0, 0, 0, 0, 0, 0}
+	if msg := alice.receive(16); !bytes.Equal(msg, expected) {
+		t.Errorf("Expected -2 and 1.5 widened, got %v", msg)
+	}
+
+	alice.sendTo("alice", types.Int32Type{}, []byte{0, 0, 0, 1})
+	alice.send(command.EmptyCommandId, types.Int64Type{}.Serialize())
+	if resp := alice.receive(1); resp[0] != 1 {
+		t.Error("Int64 queue did not opt into widening")
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	_, path := startBroker(t)
+	alice := connect(t, path, "alice")
+	alice.register()
+	v1 := types.StructType{Fields: []types.Type{types.Int32Type{}}}
+	v2 := types.StructType{Fields: []types.Type{types.Int32Type{}, types.BoolType{}}}
+	data := append(append(v2.Serialize(), command.AcceptDefaults), 0, 0, 0, 0, 1)
+	alice.send(command.AcceptTypeCommandId, data)
+	if resp := alice.receive(1); resp[0] != 0 {
+		t.Fatal("AcceptType with defaults failed")
+	}
+
+	alice.sendTo("alice", v1, []byte{0, 0, 0, 9})
+	alice.send(command.GetCommandId, v2.Serialize())
+	if msg := alice.receive(5); !bytes.Equal(msg, []byte{0, 0, 0, 9, 1}) {
+		t.Errorf("Expected the old message extended with the default, got %v", msg)
+	}
+}
+
+func TestNamedFields(t *testing.T) {
+	_, path := startBroker(t)
+	alice := connect(t, path, "alice")
+	alice.register()
+	xz := types.StructType{Fields: []types.Type{types.Int32Type{}, types.Int32Type{}}, Names: []string{"x", "z"}}
+	xyz := types.StructType{
+		Fields: []types.Type{types.Int32Type{}, types.Int32Type{}, types.Int32Type{}},
+		Names:  []string{"z", "y", "x"},
+	}
+	alice.acceptType(xz)
+	alice.sendTo("alice", xyz, []byte{0, 0, 0, 3, 0, 0, 0, 2, 0, 0, 0, 1})
+	alice.send(command.GetCommandId, xz.Serialize())
+	if msg := alice.receive(8); !bytes.Equal(msg, []byte{0, 0, 0, 1, 0, 0, 0, 3}) {
+		t.Errorf("Expected x and z by name, got %v", msg)
+	}
+}
+
+func TestCLayout(t *testing.T) {
+	_, path := startBroker(t)
+	alice := connect(t, path, "alice")
+	alice.register()
+	native := types.StructType{Fields: []types.Type{types.BoolType{}, types.Int64Type{}}, Layout: types.CLayout}
+	alice.acceptType(native)
+	packed := types.StructType{Fields: []types.Type{types.BoolType{}, types.Int64Type{}, types.CharType{}}}
+	alice.sendTo("alice", packed, []byte{1, 0, 0, 0, 0, 0, 0, 0, 2, 0, 'x'})
+	alice.send(command.GetCommandId, native.Serialize())
+	if msg := alice.receive(16); !bytes.Equal(msg, []byte{1, 0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("Expected the message laid out like C, got %v", msg)
+	}
+}
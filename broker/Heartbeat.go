@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"github.com/adrianleh/WTMP-middleend/client"
+	"github.com/adrianleh/WTMP-middleend/logging"
+	"github.com/adrianleh/WTMP-middleend/presence"
+	"github.com/google/uuid"
+	"time"
+)
+
+// PresenceEvent reports that a client's liveness changed
+type PresenceEvent struct {
+	Name     string
+	Id       uuid.UUID
+	Liveness client.Liveness
+}
+
+// WithHeartbeat Pings every client on its callback socket each interval. Clients silent for a whole interval are
+// suspect, clients silent for missedBeats intervals are dead.
+func WithHeartbeat(interval time.Duration, missedBeats uint) Option {
+	return func(b *Broker) {
+		b.heartbeatInterval = interval
+		b.missedBeats = missedBeats
+	}
+}
+
+func WithDeadClientPolicy(policy presence.DeadClientPolicy) Option {
+	return func(b *Broker) { b.deadClientPolicy = policy }
+}
+
+// WithPresenceHandler Calls handler for every liveness change, from the heartbeat goroutine
+func WithPresenceHandler(handler func(PresenceEvent)) Option {
+	return func(b *Broker) { b.presenceHandlers = append(b.presenceHandlers, handler) }
+}
+
+func (b *Broker) heartbeat() {
+	ticks := b.heartbeatTicks
+	if ticks == nil {
+		ticker := time.NewTicker(b.heartbeatInterval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	for {
+		select {
+		case now := <-ticks:
+			b.checkLiveness(now)
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+func (b *Broker) checkLiveness(now time.Time) {
+	for _, cl := range b.clients.All() {
+		missed := uint(now.Sub(cl.LastSeen()) / b.heartbeatInterval)
+		liveness := client.Alive
+		if missed >= b.missedBeats {
+			liveness = client.Dead
+		} else if missed >= 1 {
+			liveness = client.Suspect
+		}
+		if cl.SetLiveness(liveness) {
+			b.publishPresence(PresenceEvent{Name: cl.GetName(), Id: cl.GetId(), Liveness: liveness})
+			if liveness == client.Dead {
+				b.cleanUpDead(cl)
+			}
+		}
+		if liveness != client.Dead {
+			if err := cl.Notify(client.PingNotification, nil); err != nil {
+				logging.Debugf("Failed to ping client %s: %v", cl.Describe(), err)
+			}
+		}
+	}
+}
+
+func (b *Broker) publishPresence(event PresenceEvent) {
+	logging.Infof("Client %s (%s) is %s", event.Name, event.Id, event.Liveness)
+	for _, handler := range b.presenceHandlers {
+		handler(event)
+	}
+}
+
+func (b *Broker) cleanUpDead(cl *client.Client) {
+	switch b.deadClientPolicy {
+	case presence.DetachDeadClients:
+		b.clients.Detach(cl.GetId())
+	case presence.RemoveDeadClients:
+		if err := b.clients.Remove(cl.GetId()); err == nil {
+			cl.Close()
+		}
+	}
+}
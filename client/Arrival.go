@@ -0,0 +1,53 @@
+package client
+
+import (
+	"errors"
+	"github.com/adrianleh/WTMP-middleend/types"
+)
+
+var ErrNoMessage = errors.New("no message queued for any of the types")
+
+func (cl *Client) signalArrival() {
+	cl.arrivedMutex.Lock()
+	defer cl.arrivedMutex.Unlock()
+	close(cl.arrived)
+	cl.arrived = make(chan struct{})
+}
+
+// Arrival Returns a channel that is closed once the next message is pushed to any of the client's queues.
+// Fetch the channel before checking the queues to not miss a message pushed in between.
+func (cl *Client) Arrival() <-chan struct{} {
+	cl.arrivedMutex.Lock()
+	defer cl.arrivedMutex.Unlock()
+	return cl.arrived
+}
+
+// PopOldest Pops the message that arrived first among the queues of typs, nil meaning all accepted types.
+// Returns the type of the queue it was popped from, or ErrNoMessage if all of them are empty.
+func (cl *Client) PopOldest(typs []types.Type) (types.Type, []byte, error) {
+	if typs == nil {
+		typs = cl.GetAcceptedTypes()
+	}
+	cl.deliveryMutex.RLock()
+	defer cl.deliveryMutex.RUnlock()
+	for {
+		var oldest types.Type
+		var oldestSeq uint64
+		for _, typ := range typs {
+			queue := cl.queue(typ)
+			if queue == nil {
+				return nil, nil, errors.New("no queue exists for type")
+			}
+			if seq, err := queue.PeekSequence(); err == nil && (oldest == nil || seq < oldestSeq) {
+				oldest, oldestSeq = typ, seq
+			}
+		}
+		if oldest == nil {
+			return nil, nil, ErrNoMessage
+		}
+		data, err := cl.popFrom(cl.queue(oldest))
+		if err == nil {
+			return oldest, data, nil
+		} // Else another receiver emptied the queue in between, look again
+	}
+}
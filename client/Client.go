@@ -1,89 +1,233 @@
 package client
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"github.com/adrianleh/WTMP-middleend/messagequeue"
+	"github.com/adrianleh/WTMP-middleend/quota"
 	"github.com/adrianleh/WTMP-middleend/types"
 	"github.com/google/uuid"
-	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Client struct {
+	queuedBytes           uint64 // Accessed atomically, kept first for 64 bit alignment
+	quotaViolations       uint64 // Accessed atomically
+	lastSeen              int64  // Unix nanoseconds, accessed atomically
+	arrivals              uint64 // Sequence number of the last pushed message, accessed atomically
+	liveness              int32  // Accessed atomically
 	id                    uuid.UUID
 	socketPath            string
 	name                  string
 	acceptedTypes         []types.Type
-	mqs                   map[string]*messagequeue.MessageQueue
-	superTypeCache        map[string]*types.Type
+	mqs                   map[types.Fingerprint]*messagequeue.MessageQueue
+	acceptOptions         map[types.Fingerprint]AcceptOptions
+	restored              map[types.Fingerprint]bool // Queues restored from disk the client did not accept again yet
+	superTypeCache        map[types.Fingerprint]superTypeEntry
 	superTypeCacheMutex   *sync.RWMutex
-	dataStructureMutex    *sync.Mutex
-	sock                  net.Conn
+	dataStructureMutex    *sync.RWMutex // Guards acceptedTypes, mqs, acceptOptions and restored
+	deliveryMutex         *sync.RWMutex // Held shared by pushes and pops, exclusively while a transaction delivers
+	out                   *outbound
+	sockMutex             *sync.Mutex   // Guards out, id, socketPath and peer, which are replaced when a session is resumed
+	arrived               chan struct{} // Closed and replaced whenever a message is pushed
+	arrivedMutex          *sync.Mutex   // Guards arrived
 	inOrderExecutionMutex *sync.Mutex
+	maxQueueLength        uint64
+	peer                  *Peer
+	limits                quota.Limits
+	sendLimiter           *quota.SendLimiter
+	known                 *types.KnownTypes // Of the map the client was added to, nil before
+	session               *session          // nil unless registered as resumable
 }
 
 func CreateClient(id uuid.UUID, socketPath string, name string) (Client, error) {
+	return createClient(id, socketPath, name, DefaultOutboundQueueLength, DefaultWriteTimeout)
+}
+
+// CreateClient Creates a client whose callback socket uses the map's outbound queue length and write timeout
+func (clients *ClientMap) CreateClient(id uuid.UUID, socketPath string, name string) (Client, error) {
+	clients.mutex.RLock()
+	queueLength, writeTimeout := clients.outboundQueueLength, clients.writeTimeout
+	clients.mutex.RUnlock()
+	return createClient(id, socketPath, name, queueLength, writeTimeout)
+}
+
+func createClient(id uuid.UUID, socketPath string, name string, queueLength int, writeTimeout time.Duration) (Client, error) {
 	sock, err := net.Dial("unix", socketPath)
 	if err != nil {
 		return Client{}, err
 	}
 	return Client{
+		lastSeen:              time.Now().UnixNano(),
 		id:                    id,
 		socketPath:            socketPath,
 		name:                  name,
 		acceptedTypes:         make([]types.Type, 0),
-		mqs:                   map[string]*messagequeue.MessageQueue{},
-		superTypeCache:        map[string]*types.Type{},
-		dataStructureMutex:    &sync.Mutex{},
+		mqs:                   map[types.Fingerprint]*messagequeue.MessageQueue{},
+		acceptOptions:         map[types.Fingerprint]AcceptOptions{},
+		restored:              map[types.Fingerprint]bool{},
+		superTypeCache:        map[types.Fingerprint]superTypeEntry{},
+		dataStructureMutex:    &sync.RWMutex{},
+		deliveryMutex:         &sync.RWMutex{},
 		superTypeCacheMutex:   &sync.RWMutex{},
-		sock:                  sock,
+		out:                   newOutbound(sock, queueLength, writeTimeout),
+		sockMutex:             &sync.Mutex{},
+		arrived:               make(chan struct{}),
+		arrivedMutex:          &sync.Mutex{},
 		inOrderExecutionMutex: &sync.Mutex{},
 	}, nil
 }
 
+// SendToClient Queues data, the reply to a command, for the callback socket without waiting for the client to read
+// it. A client whose outbound queue overflows is disconnected.
 func (cl *Client) SendToClient(data []byte) error {
-	_, err := io.Copy(cl.sock, bytes.NewReader(data))
-	return err
+	return cl.send(EncodeReply(data))
+}
+
+// send Queues an already framed message for the callback socket
+func (cl *Client) send(data []byte) error {
+	cl.sockMutex.Lock()
+	out := cl.out
+	cl.sockMutex.Unlock()
+	return out.send(data)
+}
+
+// Close Flushes queued data and closes the callback socket
+func (cl *Client) Close() error {
+	cl.sockMutex.Lock()
+	out := cl.out
+	cl.sockMutex.Unlock()
+	return out.close()
 }
 
 func (cl *Client) GetCommandMutex() *sync.Mutex {
 	return cl.inOrderExecutionMutex
 }
 
-func (cl *Client) GetId() uuid.UUID               { return cl.id }
-func (cl *Client) GetName() string                { return cl.name }
-func (cl *Client) GetSocketPath() string          { return cl.socketPath }
-func (cl *Client) GetAcceptedTypes() []types.Type { return cl.acceptedTypes }
+func (cl *Client) GetName() string { return cl.name }
+
+func (cl *Client) GetId() uuid.UUID {
+	cl.sockMutex.Lock()
+	defer cl.sockMutex.Unlock()
+	return cl.id
+}
+
+func (cl *Client) GetSocketPath() string {
+	cl.sockMutex.Lock()
+	defer cl.sockMutex.Unlock()
+	return cl.socketPath
+}
+
+func (cl *Client) GetPeer() *Peer {
+	cl.sockMutex.Lock()
+	defer cl.sockMutex.Unlock()
+	return cl.peer
+}
+
+// GetAcceptedTypes Returns a copy of the accepted types in the order they were registered
+func (cl *Client) GetAcceptedTypes() []types.Type {
+	cl.dataStructureMutex.RLock()
+	defer cl.dataStructureMutex.RUnlock()
+	return append([]types.Type{}, cl.acceptedTypes...)
+}
+
+// SetPeer Binds the client to the process that registered it, must be called before adding it to a ClientMap
+func (cl *Client) SetPeer(peer *Peer) {
+	cl.sockMutex.Lock()
+	defer cl.sockMutex.Unlock()
+	cl.peer = peer
+}
+
+// Describe Identifies the client by name, id and owning process for logs
+func (cl *Client) Describe() string {
+	return fmt.Sprintf("%s (%s, %s)", cl.name, cl.GetId(), cl.GetPeer())
+}
 
 type ClientMap struct {
 	uuidClientMap map[uuid.UUID]*Client
 	nameClientMap map[string]*Client
+	restorable    map[string][]persistedQueue
+	known         *types.KnownTypes     // The types accepted by clients, which senders may refer to by fingerprint
+	sessions      map[uuid.UUID]*Client // By resume token
 	mutex         *sync.RWMutex
+	// maxQueueLength Bounds the number of messages held per accepted type of each client, 0 meaning unbounded
+	maxQueueLength uint64
+	limits         quota.Limits
+	sessionExpiry  time.Duration
+	// outboundQueueLength and writeTimeout Apply to the callback sockets of clients created through the map
+	outboundQueueLength int
+	writeTimeout        time.Duration
 }
 
 func CreateClientMap() ClientMap {
 	return ClientMap{
 		uuidClientMap: map[uuid.UUID]*Client{},
 		nameClientMap: map[string]*Client{},
+		restorable:    map[string][]persistedQueue{},
+		known:         types.CreateKnownTypes(),
+		sessions:      map[uuid.UUID]*Client{},
 		mutex:         &sync.RWMutex{},
+
+		outboundQueueLength: DefaultOutboundQueueLength,
+		writeTimeout:        DefaultWriteTimeout,
 	}
 }
 
+func (clients *ClientMap) SetMaxQueueLength(maxQueueLength uint64) {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+	clients.maxQueueLength = maxQueueLength
+}
+
+// SetOutbound Sets how many messages may wait for a client's callback socket and how long a single write may take
+func (clients *ClientMap) SetOutbound(queueLength int, writeTimeout time.Duration) {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+	clients.outboundQueueLength = queueLength
+	clients.writeTimeout = writeTimeout
+}
+
+// SetLimits Applies limits to clients added from now on
+func (clients *ClientMap) SetLimits(limits quota.Limits) {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+	clients.limits = limits
+}
+
 func (clients *ClientMap) Remove(id uuid.UUID) error {
 	clients.mutex.Lock()
 	defer clients.mutex.Unlock()
 	if clients.uuidClientMap[id] == nil {
 		return fmt.Errorf("client with id \"%s\" does not exist", id.String())
 	}
-	name := clients.uuidClientMap[id].GetName()
-	clients.nameClientMap[name] = nil
-	clients.uuidClientMap[id] = nil
+	clients.removeLocked(clients.uuidClientMap[id])
 	return nil
 }
 
+func (clients *ClientMap) removeLocked(cl *Client) {
+	clients.forget(cl)
+	delete(clients.nameClientMap, cl.GetName())
+	delete(clients.uuidClientMap, cl.GetId())
+	if cl.session != nil {
+		delete(clients.sessions, cl.session.token)
+	}
+}
+
+// forget Forgets the types accepted by cl
+func (clients *ClientMap) forget(cl *Client) {
+	for _, typ := range cl.GetAcceptedTypes() {
+		clients.known.Forget(typ)
+	}
+}
+
+// DeserializeType Decodes a serialized type, which may also be a reference to a type accepted by a client
+func (clients *ClientMap) DeserializeType(raw []byte) (types.Type, error) {
+	return clients.known.Deserialize(raw)
+}
+
 func (clients *ClientMap) GetByName(name string) *Client {
 	clients.mutex.RLock()
 	defer clients.mutex.RUnlock()
@@ -103,77 +247,272 @@ func (clients *ClientMap) Add(client *Client) error {
 	if clients.nameClientMap[name] != nil {
 		return fmt.Errorf("client named \"%s\" already exists", name)
 	}
+	if clients.uuidClientMap[client.GetId()] != nil {
+		return fmt.Errorf("client with id \"%s\" already exists", client.GetId().String())
+	}
+	if clients.limits.MaxClients != 0 && uint64(len(clients.uuidClientMap)) >= clients.limits.MaxClients {
+		return quota.Exceeded("max_clients")
+	}
+	client.maxQueueLength = clients.maxQueueLength
+	client.limits = clients.limits
+	client.sendLimiter = quota.NewSendLimiter(clients.limits)
+	client.known = clients.known
+	clients.restore(client)
 	clients.nameClientMap[name] = client
 	clients.uuidClientMap[client.GetId()] = client
 	return nil
 }
 
-var Clients = CreateClientMap()
+// queue Returns the queue of an accepted type, nil if the type is not accepted
+func (cl *Client) queue(typ types.Type) *messagequeue.MessageQueue {
+	return cl.queueOf(types.FingerprintOf(typ))
+}
+
+// queueOf Is queue for the type with fingerprint fp
+func (cl *Client) queueOf(fp types.Fingerprint) *messagequeue.MessageQueue {
+	cl.dataStructureMutex.RLock()
+	defer cl.dataStructureMutex.RUnlock()
+	return cl.mqs[fp]
+}
 
 func (cl *Client) Pop(typ types.Type) ([]byte, error) {
-	if queue := cl.mqs[typ.Name()]; queue != nil {
-		return queue.Pop()
+	cl.deliveryMutex.RLock()
+	defer cl.deliveryMutex.RUnlock()
+	if queue := cl.queue(typ); queue != nil {
+		return cl.popFrom(queue)
 	}
 	return nil, fmt.Errorf("no queue found for type \"%s\"", typ.Name())
 }
 
+func (cl *Client) popFrom(queue *messagequeue.MessageQueue) ([]byte, error) {
+	data, err := queue.Pop()
+	if err == nil {
+		atomic.AddUint64(&cl.queuedBytes, ^uint64(len(data)-1))
+	}
+	return data, err
+}
+
 func (cl *Client) Empty(typ types.Type) (bool, error) {
-	if queue := cl.mqs[typ.Name()]; queue != nil {
+	cl.deliveryMutex.RLock()
+	defer cl.deliveryMutex.RUnlock()
+	if queue := cl.queue(typ); queue != nil {
 		return queue.Empty(), nil
 	}
 	return false, errors.New("no queue exists for type")
 }
 
 func (cl *Client) PushToSuperType(typ types.Type, superType types.Type, data []byte) error {
-	trimmedData, err := types.Trim(typ, superType, data)
+	return cl.pushTo(typ, superType, types.FingerprintOf(superType), data)
+}
+
+// pushTo Is PushToSuperType given the fingerprint of superType
+func (cl *Client) pushTo(typ types.Type, superType types.Type, superFp types.Fingerprint, data []byte) error {
+	trimmedData, err := cl.trim(typ, superType, superFp, data)
 	if err != nil {
 		return err
 	}
-	queue := cl.mqs[superType.Name()]
-	return queue.Push(trimmedData)
+	cl.deliveryMutex.RLock()
+	defer cl.deliveryMutex.RUnlock()
+	size := uint64(len(trimmedData))
+	queuedBytes := atomic.AddUint64(&cl.queuedBytes, size)
+	if cl.limits.MaxQueuedBytes != 0 && queuedBytes > cl.limits.MaxQueuedBytes {
+		atomic.AddUint64(&cl.queuedBytes, ^(size - 1))
+		return cl.quotaExceeded("max_queued_bytes")
+	}
+	queue := cl.queueOf(superFp)
+	if queue == nil {
+		atomic.AddUint64(&cl.queuedBytes, ^(size - 1))
+		return fmt.Errorf("no queue found for type \"%s\"", superType.Name())
+	}
+	if err := queue.PushSequenced(trimmedData, atomic.AddUint64(&cl.arrivals, 1)); err != nil {
+		atomic.AddUint64(&cl.queuedBytes, ^(size - 1))
+		return err
+	}
+	cl.signalArrival()
+	return nil
 }
 
+// Push Pushes data of typ to the queue of the accepted super type it goes to. The fingerprints of typ and of the
+// super type are computed at most once.
 func (cl *Client) Push(typ types.Type, data []byte) error {
-	if superType := cl.getFromSuperTypeCache(typ); superType != nil {
-		return cl.PushToSuperType(typ, *superType, data)
-	}
-	superTypes := typ.GetSuperTypes()
-	for _, superType := range superTypes {
-		if queue := cl.mqs[superType.Name()]; queue != nil {
-			cl.addToSuperTypeCache(typ, &superType)
-			return cl.PushToSuperType(typ, superType, data)
+	superType, superFp, err := cl.acceptingSuperType(typ, types.FingerprintOf(typ))
+	if err != nil {
+		return err
+	}
+	return cl.pushTo(typ, superType, superFp, data)
+}
+
+// acceptingSuperType Returns the super type of typ, possibly typ itself, whose queue messages of typ go to: the
+// closest accepted one or, failing that, the closest one accepting widened messages or the first one with defaults to
+// extend messages with. fp is the fingerprint of typ, the super type's is returned along with it.
+func (cl *Client) acceptingSuperType(typ types.Type, fp types.Fingerprint) (types.Type, types.Fingerprint, error) {
+	if entry, ok := cl.getFromSuperTypeCache(fp); ok {
+		return entry.typ, entry.fp, nil
+	}
+	if queue := cl.queueOf(fp); queue != nil {
+		return cl.addToSuperTypeCache(fp, typ, fp)
+	}
+	if superType, superFp, ok := cl.enumeratedSuperType(typ); ok {
+		return cl.addToSuperTypeCache(fp, superType, superFp)
+	}
+	accepted := cl.GetAcceptedTypes()
+	if i := types.ClosestSuperType(typ, accepted); i >= 0 {
+		return cl.addToSuperTypeCache(fp, accepted[i], types.FingerprintOf(accepted[i]))
+	}
+	widening := cl.wideningTypes()
+	if i := types.ClosestWideningSuperType(typ, widening); i >= 0 {
+		return cl.addToSuperTypeCache(fp, widening[i], types.FingerprintOf(widening[i]))
+	}
+	for _, acceptedTyp := range accepted {
+		acceptedFp := types.FingerprintOf(acceptedTyp)
+		if opts := cl.acceptOptionsOf(acceptedFp); opts.Defaults != nil && opts.Defaults.CanExtend(typ, opts.Widen) {
+			return cl.addToSuperTypeCache(fp, acceptedTyp, acceptedFp)
 		}
 	}
-	return fmt.Errorf("no queue found for type \"%s\"", typ.Name())
+	return nil, types.Fingerprint{}, fmt.Errorf("no queue found for type \"%s\"", typ.Name())
+}
+
+// maxEnumeratedSuperTypes Bounds the super types enumeratedSuperType looks up before leaving the search to a scan
+// of the accepted types
+const maxEnumeratedSuperTypes = 64
+
+// enumeratedSuperType Looks the first super types of typ up among the accepted types. Types are enumerated before
+// their super types, so if all super types of typ are enumerated the first accepted one is the closest.
+func (cl *Client) enumeratedSuperType(typ types.Type) (types.Type, types.Fingerprint, bool) {
+	if !types.SuperTypesEnumerable(typ) {
+		return nil, types.Fingerprint{}, false
+	}
+	var found types.Type
+	var foundFp types.Fingerprint
+	looked := 0
+	types.EachSuperType(typ, func(superType types.Type) bool {
+		looked++
+		if looked == 1 {
+			return true // typ itself, looked up already
+		}
+		superFp := types.FingerprintOf(superType)
+		if cl.queueOf(superFp) != nil {
+			found, foundFp = superType, superFp
+		}
+		return found == nil && looked < maxEnumeratedSuperTypes
+	})
+	return found, foundFp, found != nil
+}
+
+// AcceptOptions are chosen by a client for each type it accepts
+type AcceptOptions struct {
+	// Widen Lets messages be converted by widening numbers, see types.IsWideningSubtype
+	Widen bool
+	// Defaults Lets messages of older versions of a struct, lacking its trailing fields, be extended, may be nil
+	Defaults *types.Defaults
 }
 
 func (cl *Client) RegisterType(typ types.Type) error {
-	if cl.mqs[typ.Name()] != nil {
-		return errors.New("type already registered")
+	return cl.RegisterTypeWithOptions(typ, AcceptOptions{})
+}
+
+// RegisterTypeWithOptions Creates a queue for typ. Accepting the type of a queue restored from disk again keeps its
+// messages and replaces its options.
+func (cl *Client) RegisterTypeWithOptions(typ types.Type, opts AcceptOptions) error {
+	if err := types.CheckNames(typ); err != nil {
+		return err
 	}
+	if opts.Defaults != nil && !types.Same(opts.Defaults.Typ, typ) {
+		return errors.New("defaults are for another type")
+	}
+	fp := types.FingerprintOf(typ)
 	cl.dataStructureMutex.Lock()
+	if cl.mqs[fp] != nil && cl.restored[fp] {
+		delete(cl.restored, fp)
+		cl.acceptOptions[fp] = opts
+		cl.dataStructureMutex.Unlock()
+		cl.invalidateSuperTypeCache()
+		return nil
+	}
+	if cl.mqs[fp] != nil {
+		cl.dataStructureMutex.Unlock()
+		return errors.New("type already registered")
+	}
+	if cl.limits.MaxAcceptedTypes != 0 && uint64(len(cl.acceptedTypes)) >= cl.limits.MaxAcceptedTypes {
+		cl.dataStructureMutex.Unlock()
+		return cl.quotaExceeded("max_accepted_types")
+	}
 	cl.acceptedTypes = append(cl.acceptedTypes, typ)
-	queue := messagequeue.CreateMessageQueue(typ.Size())
-	cl.mqs[typ.Name()] = &queue
+	queue := messagequeue.CreateBoundedMessageQueue(typ.Size(), cl.maxQueueLength)
+	if !types.FixedSize(typ) {
+		queue = messagequeue.CreateVariableMessageQueue(cl.maxQueueLength)
+	}
+	cl.mqs[fp] = &queue
+	cl.acceptOptions[fp] = opts
 	cl.dataStructureMutex.Unlock()
 	cl.invalidateSuperTypeCache()
+	if cl.known != nil {
+		cl.known.Remember(typ) // Senders may refer to accepted types by fingerprint
+	}
 	return nil
 }
 
-func (cl *Client) addToSuperTypeCache(typ types.Type, super *types.Type) {
-	cl.superTypeCacheMutex.RLock() // We don't need a write lock here since overwriting is safe - as it would always be the same value
-	defer cl.superTypeCacheMutex.RUnlock()
-	cl.superTypeCache[typ.Name()] = super
+// wideningTypes Returns the accepted types that messages may be widened to
+func (cl *Client) wideningTypes() []types.Type {
+	cl.dataStructureMutex.RLock()
+	defer cl.dataStructureMutex.RUnlock()
+	var widening []types.Type
+	for _, typ := range cl.acceptedTypes {
+		if cl.acceptOptions[types.FingerprintOf(typ)].Widen {
+			widening = append(widening, typ)
+		}
+	}
+	return widening
+}
+
+func (cl *Client) getAcceptOptions(typ types.Type) AcceptOptions {
+	return cl.acceptOptionsOf(types.FingerprintOf(typ))
+}
+
+// acceptOptionsOf Is getAcceptOptions for the type with fingerprint fp
+func (cl *Client) acceptOptionsOf(fp types.Fingerprint) AcceptOptions {
+	cl.dataStructureMutex.RLock()
+	defer cl.dataStructureMutex.RUnlock()
+	return cl.acceptOptions[fp]
+}
+
+// trim Projects data of typ to superType, whose fingerprint is superFp, widening numbers or filling in defaults if
+// the queue of superType accepts that
+func (cl *Client) trim(typ types.Type, superType types.Type, superFp types.Fingerprint, data []byte) ([]byte, error) {
+	opts := cl.acceptOptionsOf(superFp)
+	if opts.Defaults != nil && opts.Defaults.CanExtend(typ, opts.Widen) {
+		return opts.Defaults.Extend(typ, data, opts.Widen)
+	}
+	if opts.Widen {
+		return types.TrimWidening(typ, superType, data)
+	}
+	return types.Trim(typ, superType, data)
+}
+
+// superTypeEntry Caches the accepting super type of a type along with the super type's fingerprint
+type superTypeEntry struct {
+	typ types.Type
+	fp  types.Fingerprint
+}
+
+// addToSuperTypeCache Caches superType, with fingerprint superFp, for the type with fingerprint fp and returns it
+func (cl *Client) addToSuperTypeCache(fp types.Fingerprint, superType types.Type,
+	superFp types.Fingerprint) (types.Type, types.Fingerprint, error) {
+	cl.superTypeCacheMutex.Lock()
+	defer cl.superTypeCacheMutex.Unlock()
+	cl.superTypeCache[fp] = superTypeEntry{typ: superType, fp: superFp}
+	return superType, superFp, nil
 }
 
-func (cl *Client) getFromSuperTypeCache(typ types.Type) *types.Type {
+func (cl *Client) getFromSuperTypeCache(fp types.Fingerprint) (superTypeEntry, bool) {
 	cl.superTypeCacheMutex.RLock()
 	defer cl.superTypeCacheMutex.RUnlock()
-	return cl.superTypeCache[typ.Name()]
+	entry, ok := cl.superTypeCache[fp]
+	return entry, ok
 }
 
 func (cl *Client) invalidateSuperTypeCache() {
 	cl.superTypeCacheMutex.Lock() // Once this is executed future reads are blocked until we unlock
 	defer cl.superTypeCacheMutex.Unlock()
-	cl.superTypeCache = map[string]*types.Type{}
+	cl.superTypeCache = map[types.Fingerprint]superTypeEntry{}
 }
@@ -0,0 +1,284 @@
+package client
+
+import (
+	"fmt"
+	"github.com/adrianleh/WTMP-middleend/types"
+	"github.com/google/uuid"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// callbackListener Accepts callback connections and discards whatever the broker writes to them
+func callbackListener(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "callback.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	return path
+}
+
+func TestConcurrentClients(t *testing.T) {
+	const (
+		noClients   = 4
+		noSenders   = 8
+		noReceivers = 4
+		noMessages  = 500
+	)
+	path := callbackListener(t)
+	clients := CreateClientMap()
+	header := types.StructType{Fields: []types.Type{types.Int32Type{}}}
+	message := types.StructType{Fields: []types.Type{types.Int32Type{}, types.Int64Type{}, types.BoolType{}}}
+	var tokens []uuid.UUID
+	for i := 0; i < noClients; i++ {
+		cl, err := clients.CreateClient(uuid.New(), path, fmt.Sprintf("client-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := clients.AddResumable(&cl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+		if err := cl.RegisterType(header); err != nil {
+			t.Fatal(err)
+		}
+	}
+	byName := func(i int) *Client { return clients.GetByName(fmt.Sprintf("client-%d", i%noClients)) }
+
+	var pushed, popped int64
+	done := make(chan struct{})
+	workers := &sync.WaitGroup{}
+	background := &sync.WaitGroup{}
+
+	for s := 0; s < noSenders; s++ {
+		workers.Add(1)
+		go func(s int) {
+			defer workers.Done()
+			for i := 0; i < noMessages; i++ {
+				if byName(s+i).Push(message, make([]byte, message.Size())) == nil {
+					atomic.AddInt64(&pushed, 1)
+				}
+			}
+		}(s)
+	}
+	for r := 0; r < noReceivers; r++ {
+		background.Add(1)
+		go func(r int) {
+			defer background.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				cl := byName(r)
+				if empty, err := cl.Empty(header); err == nil && !empty {
+					if _, err := cl.Pop(header); err == nil {
+						atomic.AddInt64(&popped, 1)
+					}
+				}
+			}
+		}(r)
+	}
+	workers.Add(1)
+	go func() { // Registrations invalidate the super type caches the senders use
+		defer workers.Done()
+		for i := 0; i < 50; i++ {
+			fields := []types.Type{types.Float64Type{}}
+			for j := 0; j < i; j++ {
+				fields = append(fields, types.CharType{})
+			}
+			_ = byName(i).RegisterType(types.StructType{Fields: fields})
+		}
+	}()
+	workers.Add(1)
+	go func() { // Resuming re-keys clients while others look them up
+		defer workers.Done()
+		for i := 0; i < 50; i++ {
+			sock, err := net.Dial("unix", path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			clients.Detach(byName(i).GetId())
+			if _, err := clients.Resume(tokens[i%noClients], uuid.New(), path, sock, nil); err != nil {
+				t.Error(err)
+				sock.Close()
+			}
+		}
+	}()
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, cl := range clients.All() {
+				_ = cl.Stats()
+				_ = cl.Describe()
+				_ = cl.SendToClient([]byte{0})
+			}
+		}
+	}()
+
+	workers.Wait()
+	close(done)
+	background.Wait()
+
+	queued := int64(0)
+	for _, cl := range clients.All() {
+		queued += int64(cl.Stats().QueuedMessages)
+	}
+	if pushed != noSenders*noMessages {
+		t.Errorf("Expected %d messages pushed, got %d", noSenders*noMessages, pushed)
+	}
+	if popped+queued != pushed {
+		t.Errorf("Pushed %d messages but popped %d and %d are queued", pushed, popped, queued)
+	}
+	for i := 0; i < noClients; i++ {
+		byName(i).Close()
+	}
+}
+
+func TestPopOldest(t *testing.T) {
+	clients := CreateClientMap()
+	cl, err := clients.CreateClient(uuid.New(), callbackListener(t), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if err := clients.Add(&cl); err != nil {
+		t.Fatal(err)
+	}
+	_ = cl.RegisterType(types.Int32Type{})
+	_ = cl.RegisterType(types.BoolType{})
+	_ = cl.Push(types.BoolType{}, []byte{1})
+	_ = cl.Push(types.Int32Type{}, []byte{0, 0, 0, 2})
+	_ = cl.Push(types.BoolType{}, []byte{3})
+
+	for _, expected := range []types.Type{types.BoolType{}, types.Int32Type{}, types.BoolType{}} {
+		typ, _, err := cl.PopOldest(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ.Name() != expected.Name() {
+			t.Errorf("Expected %s, got %s", expected.Name(), typ.Name())
+		}
+	}
+	if _, _, err := cl.PopOldest([]types.Type{types.Int32Type{}}); err != ErrNoMessage {
+		t.Errorf("Expected no message, got %v", err)
+	}
+}
+
+func TestQueuesKeyedByStructure(t *testing.T) {
+	cl, err := CreateClient(uuid.New(), callbackListener(t), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	emptyThenInt := types.StructType{Fields: []types.Type{types.StructType{}, types.Int32Type{}}}
+	nested := types.StructType{Fields: []types.Type{types.StructType{Fields: []types.Type{types.Int32Type{}}}}}
+	if err := cl.RegisterType(emptyThenInt); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.RegisterType(nested); err != nil {
+		t.Errorf("Types with the same name but different structure need their own queues: %v", err)
+	}
+	_ = cl.Push(nested, []byte{0, 0, 0, 1})
+	if empty, _ := cl.Empty(emptyThenInt); !empty {
+		t.Error("Message went to the wrong queue")
+	}
+	unnamed := types.StructType{Fields: []types.Type{types.Int32Type{}}, Names: []string{}}
+	if err := cl.RegisterType(unnamed); err == nil {
+		t.Error("Expected a named struct without a name per field to be refused")
+	}
+}
+
+func TestClosestAcceptedSuperType(t *testing.T) {
+	cl, err := CreateClient(uuid.New(), callbackListener(t), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	point := types.StructType{Fields: []types.Type{types.Int32Type{}, types.Int32Type{}}}
+	point3D := types.StructType{Fields: []types.Type{types.Int32Type{}, types.Int32Type{}, types.Int32Type{}}}
+	segment := types.StructType{Fields: []types.Type{point, point}}
+	for _, typ := range []types.Type{types.StructType{Fields: []types.Type{point}}, segment} {
+		if err := cl.RegisterType(typ); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segment3D := types.StructType{Fields: []types.Type{point3D, point3D}}
+	if err := cl.Push(segment3D, make([]byte, 24)); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := cl.Pop(segment)
+	if err != nil || len(msg) != 16 {
+		t.Errorf("Expected the message projected to the closest super type, got %v %v", msg, err)
+	}
+
+	if err := cl.RegisterType(types.StructType{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Push(types.StructType{Fields: []types.Type{types.BoolType{}}}, []byte{1}); err == nil {
+		t.Error("Accepting the empty struct should not mean receiving every struct")
+	}
+	named := types.StructType{Fields: []types.Type{point3D, point3D}, Names: []string{"to", "from"}}
+	if err := cl.Push(named, make([]byte, 24)); err != nil {
+		t.Errorf("Types whose super types are not all enumerated should still be delivered, got %v", err)
+	}
+}
+
+func TestRemoveForgetsAcceptedTypes(t *testing.T) {
+	clients := CreateClientMap()
+	typ := types.StructType{Fields: []types.Type{types.Int32Type{}, types.CharType{}}}
+	var ids []uuid.UUID
+	for _, name := range []string{"alice", "bob"} {
+		cl, err := clients.CreateClient(uuid.New(), callbackListener(t), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cl.Close()
+		if err := clients.Add(&cl); err != nil {
+			t.Fatal(err)
+		}
+		if err := cl.RegisterType(typ); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, cl.GetId())
+	}
+	other := CreateClientMap()
+	if _, err := other.DeserializeType(types.Reference(typ)); err == nil {
+		t.Error("Other maps should not resolve the reference")
+	}
+	for i, id := range ids {
+		if _, err := clients.DeserializeType(types.Reference(typ)); err != nil {
+			t.Errorf("Expected the reference to resolve while accepted, got %v", err)
+		}
+		if err := clients.Remove(id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := clients.DeserializeType(types.Reference(typ)); (err == nil) != (i == 0) {
+			t.Errorf("Expected the reference to resolve until the last accepting client is removed, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type Liveness int32
+
+const (
+	Alive Liveness = iota
+	// Suspect clients missed at least one heartbeat
+	Suspect
+	// Dead clients missed as many heartbeats as the broker tolerates
+	Dead
+)
+
+func (liveness Liveness) String() string {
+	switch liveness {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// Touch Records that the client has just shown a sign of life
+func (cl *Client) Touch() {
+	atomic.StoreInt64(&cl.lastSeen, time.Now().UnixNano())
+}
+
+func (cl *Client) LastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&cl.lastSeen))
+}
+
+func (cl *Client) Liveness() Liveness {
+	return Liveness(atomic.LoadInt32(&cl.liveness))
+}
+
+// SetLiveness Updates the liveness, reporting whether it changed
+func (cl *Client) SetLiveness(liveness Liveness) bool {
+	return Liveness(atomic.SwapInt32(&cl.liveness, int32(liveness))) != liveness
+}
@@ -0,0 +1,42 @@
+package client
+
+import "encoding/binary"
+
+// Everything the broker writes to a client's callback socket is framed so replies can be told apart from
+// notifications. Replies to commands are framed as ReplyMarker and a 4 byte big endian length, followed by the reply.
+// Notifications are messages the broker writes without the client asking for them. They are framed as
+// NotificationMarker, the notification kind and a 4 byte big endian payload length, followed by the payload.
+const (
+	ReplyMarker        = byte(0x00)
+	NotificationMarker = byte(0xFF)
+)
+
+const (
+	ShutdownNotification = byte(0)
+	// DeniedNotification carries the reason a command was rejected by the broker's policy
+	DeniedNotification = byte(1)
+	// QuotaNotification carries the quota a command of the client exceeded
+	QuotaNotification = byte(2)
+	// PingNotification asks the client to prove it is alive by issuing any command, e.g. Ping
+	PingNotification = byte(3)
+)
+
+// EncodeReply Frames a reply for writing straight to a callback socket that has no client yet
+func EncodeReply(data []byte) []byte {
+	frame := make([]byte, 5, 5+len(data))
+	frame[0] = ReplyMarker
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(data)))
+	return append(frame, data...)
+}
+
+func encodeNotification(kind byte, payload []byte) []byte {
+	frame := make([]byte, 6, 6+len(payload))
+	frame[0] = NotificationMarker
+	frame[1] = kind
+	binary.BigEndian.PutUint32(frame[2:6], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+func (cl *Client) Notify(kind byte, payload []byte) error {
+	return cl.send(encodeNotification(kind, payload))
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultOutboundQueueLength = 1024
+	DefaultWriteTimeout        = 5 * time.Second
+	// maxCoalescedWrites bounds how many queued messages are written with a single vectored write
+	maxCoalescedWrites = 64
+)
+
+var errOutboundClosed = errors.New("callback socket closed")
+
+// outbound Writes to a client's callback socket from its own goroutine so a slow receiver only ever blocks itself.
+// Messages are written in the order they were queued. A receiver falling behind by more than the queue length or
+// not accepting a write within the write timeout is disconnected.
+type outbound struct {
+	sock         net.Conn
+	queue        chan []byte
+	writeTimeout time.Duration
+	mutex        *sync.Mutex // Guards closed and closing queue
+	closed       bool
+	done         chan struct{} // Closed once the writer has exited and closed sock
+}
+
+func newOutbound(sock net.Conn, queueLength int, writeTimeout time.Duration) *outbound {
+	out := &outbound{
+		sock:         sock,
+		queue:        make(chan []byte, queueLength),
+		writeTimeout: writeTimeout,
+		mutex:        &sync.Mutex{},
+		done:         make(chan struct{}),
+	}
+	go out.write()
+	return out
+}
+
+func (out *outbound) send(data []byte) error {
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+	if out.closed {
+		return errOutboundClosed
+	}
+	select {
+	case out.queue <- data:
+		return nil
+	default:
+		out.abortLocked()
+		return errors.New("outbound queue overflow, disconnected")
+	}
+}
+
+// close Stops accepting messages and waits up to the write timeout for the writer to flush what is queued
+func (out *outbound) close() error {
+	out.mutex.Lock()
+	out.closeLocked()
+	out.mutex.Unlock()
+	select {
+	case <-out.done:
+		return nil
+	case <-time.After(out.writeTimeout):
+		return out.abort()
+	}
+}
+
+// abort Stops accepting messages and disconnects right away, dropping what is queued
+func (out *outbound) abort() error {
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+	return out.abortLocked()
+}
+
+func (out *outbound) abortLocked() error {
+	out.closeLocked()
+	return out.sock.Close()
+}
+
+func (out *outbound) closeLocked() {
+	if !out.closed {
+		out.closed = true
+		close(out.queue)
+	}
+}
+
+func (out *outbound) write() {
+	defer close(out.done)
+	defer out.sock.Close()
+	failed := false
+	for data := range out.queue {
+		if failed {
+			continue // Drain until close so senders are not blocked
+		}
+		batch := net.Buffers{data}
+	coalesce:
+		for len(batch) < maxCoalescedWrites {
+			select {
+			case more, ok := <-out.queue:
+				if !ok {
+					break coalesce
+				}
+				batch = append(batch, more)
+			default:
+				break coalesce
+			}
+		}
+		_ = out.sock.SetWriteDeadline(time.Now().Add(out.writeTimeout))
+		if _, err := batch.WriteTo(out.sock); err != nil {
+			failed = true
+			out.abort()
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOutboundKeepsOrder(t *testing.T) {
+	broker, receiver := net.Pipe()
+	out := newOutbound(broker, 200, time.Second)
+	for i := 0; i < 200; i++ {
+		if err := out.send([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go out.close()
+	received, err := ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 200 {
+		t.Fatalf("Expected 200 bytes, got %d", len(received))
+	}
+	for i, b := range received {
+		if b != byte(i) {
+			t.Fatalf("Message %d arrived as %d", i, b)
+		}
+	}
+}
+
+func TestOutboundOverflowDisconnects(t *testing.T) {
+	broker, receiver := net.Pipe()
+	out := newOutbound(broker, 2, time.Minute)
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = out.send([]byte{byte(i)}) // Nobody reads, so the writer blocks and the queue fills up
+	}
+	if err == nil {
+		t.Fatal("Queue should overflow")
+	}
+	if err := out.send([]byte{0}); err != errOutboundClosed {
+		t.Errorf("Expected the client to be disconnected, got %v", err)
+	}
+	_ = receiver.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.Copy(ioutil.Discard, receiver); err != nil {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+func TestOutboundWriteTimeout(t *testing.T) {
+	broker, _ := net.Pipe()
+	out := newOutbound(broker, 10, 20*time.Millisecond)
+	if err := out.send([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-out.done:
+	case <-time.After(time.Second):
+		t.Fatal("Stalled write should disconnect")
+	}
+	if err := out.send([]byte{2}); err != errOutboundClosed {
+		t.Errorf("Expected the client to be disconnected, got %v", err)
+	}
+}
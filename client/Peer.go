@@ -0,0 +1,22 @@
+package client
+
+import "fmt"
+
+// Peer identifies the process on the other end of a connection to the broker
+type Peer struct {
+	Uid uint32
+	Gid uint32
+	Pid int32
+}
+
+func (peer *Peer) String() string {
+	if peer == nil {
+		return "unknown peer"
+	}
+	return fmt.Sprintf("uid=%d gid=%d pid=%d", peer.Uid, peer.Gid, peer.Pid)
+}
+
+// SameProcess Reports whether both peers are the same process, an unknown peer is never the same as any other
+func (peer *Peer) SameProcess(other *Peer) bool {
+	return peer != nil && other != nil && *peer == *other
+}
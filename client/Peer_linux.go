@@ -0,0 +1,34 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// PeerCredentialsSupported Tells whether PeerOf can identify peers on this platform
+const PeerCredentialsSupported = true
+
+// PeerOf Reads the credentials of the process connected through conn using SO_PEERCRED
+func PeerOf(conn net.Conn) (*Peer, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("peer credentials require a unix socket")
+	}
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	return &Peer{Uid: cred.Uid, Gid: cred.Gid, Pid: cred.Pid}, nil
+}
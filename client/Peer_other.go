@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import (
+	"errors"
+	"net"
+)
+
+// PeerCredentialsSupported Tells whether PeerOf can identify peers on this platform
+const PeerCredentialsSupported = false
+
+// PeerOf Is only supported on linux, elsewhere peers stay unknown
+func PeerOf(net.Conn) (*Peer, error) {
+	return nil, errors.New("peer credentials are only supported on linux")
+}
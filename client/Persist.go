@@ -0,0 +1,283 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/adrianleh/WTMP-middleend/logging"
+	"github.com/adrianleh/WTMP-middleend/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+const persistedFileSuffix = ".wtmpq"
+
+const (
+	// persistedWiden Flags a persisted queue accepting widened messages
+	persistedWiden = byte(1)
+	// persistedDefaults Flags a persisted queue with defaults, their payload follows the flags prefixed by its length
+	persistedDefaults = byte(2)
+)
+
+type persistedQueue struct {
+	typ      types.Type
+	opts     AcceptOptions
+	messages [][]byte
+}
+
+// All Returns a snapshot of all registered clients
+func (clients *ClientMap) All() []*Client {
+	clients.mutex.RLock()
+	defer clients.mutex.RUnlock()
+	all := make([]*Client, 0, len(clients.uuidClientMap))
+	for _, cl := range clients.uuidClientMap {
+		if cl != nil {
+			all = append(all, cl)
+		}
+	}
+	return all
+}
+
+// Persist Writes the queues of every registered client to dir, one file per client, as well as the queues loaded
+// for clients that did not register again since, so they are not lost.
+// Files are named after the hex encoded client name so any name maps to a valid file name.
+func (clients *ClientMap) Persist(dir string) error {
+	pending := map[string][]persistedQueue{}
+	clients.mutex.RLock()
+	for name, queues := range clients.restorable {
+		pending[name] = queues
+	}
+	clients.mutex.RUnlock()
+	for _, cl := range clients.All() {
+		pending[cl.GetName()] = cl.persistedQueues()
+	}
+	var errs []string
+	for name, queues := range pending {
+		path := filepath.Join(dir, hex.EncodeToString([]byte(name))+persistedFileSuffix)
+		if err := writeFileAtomic(path, serializeQueues(queues)); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// LoadPersisted Reads the queues persisted to dir and removes the files.
+// The queues are restored when a client registers with the same name again.
+func (clients *ClientMap) LoadPersisted(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+persistedFileSuffix))
+	if err != nil {
+		return err
+	}
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+	for _, path := range paths {
+		rawName, err := hex.DecodeString(strings.TrimSuffix(filepath.Base(path), persistedFileSuffix))
+		if err != nil {
+			return fmt.Errorf("%s: invalid file name", path)
+		}
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		queues, err := deserializeQueues(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		clients.restorable[string(rawName)] = queues
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restore Re-creates queues persisted for the client's name, caller must hold the map's write lock. Limits may have
+// been lowered since the queues were persisted: queues and messages beyond them are dropped with a warning rather
+// than keeping the client from registering.
+func (clients *ClientMap) restore(cl *Client) {
+	queues := clients.restorable[cl.GetName()]
+	if queues == nil {
+		return
+	}
+	delete(clients.restorable, cl.GetName())
+	for _, queue := range queues {
+		if max := cl.limits.MaxAcceptedTypes; max != 0 && uint64(len(cl.GetAcceptedTypes())) >= max {
+			logging.Warnf("Dropping restored queue of %d messages of type %s for client %s: exceeds max_accepted_types",
+				len(queue.messages), queue.typ.Name(), cl.GetName())
+			continue
+		}
+		if err := cl.RegisterTypeWithOptions(queue.typ, queue.opts); err != nil {
+			logging.Warnf("Dropping restored queue of %d messages of type %s for client %s: %v",
+				len(queue.messages), queue.typ.Name(), cl.GetName(), err)
+			continue
+		}
+		cl.markRestored(queue.typ)
+		dropped := 0
+		for _, msg := range queue.messages {
+			max := cl.limits.MaxQueuedBytes
+			if max != 0 && atomic.LoadUint64(&cl.queuedBytes)+uint64(len(msg)) > max {
+				dropped++ // Checked here so the client is not charged a quota violation
+				continue
+			}
+			if err := cl.Push(queue.typ, msg); err != nil {
+				dropped++
+			}
+		}
+		if dropped > 0 {
+			logging.Warnf("Dropped %d of %d restored messages of type %s for client %s, they exceed its limits",
+				dropped, len(queue.messages), queue.typ.Name(), cl.GetName())
+		}
+	}
+}
+
+// markRestored Lets the client accept typ again, see RegisterTypeWithOptions
+func (cl *Client) markRestored(typ types.Type) {
+	cl.dataStructureMutex.Lock()
+	defer cl.dataStructureMutex.Unlock()
+	cl.restored[types.FingerprintOf(typ)] = true
+}
+
+// persistedQueues Returns a snapshot of the client's queues
+func (cl *Client) persistedQueues() []persistedQueue {
+	acceptedTypes := cl.GetAcceptedTypes()
+	queues := make([]persistedQueue, len(acceptedTypes))
+	for i, typ := range acceptedTypes {
+		queues[i] = persistedQueue{typ: typ, opts: cl.getAcceptOptions(typ), messages: cl.queue(typ).Snapshot()}
+	}
+	return queues
+}
+
+// serializeQueues Encodes the number of queues followed by, per queue, the serialized type, its option flags (1),
+// the payload of its defaults if any, the number of messages and each message, payloads prefixed by their length
+func serializeQueues(queues []persistedQueue) []byte {
+	var buf bytes.Buffer
+	writeUint32(&buf, uint32(len(queues)))
+	for _, queue := range queues {
+		buf.Write(queue.typ.Serialize())
+		var flags byte
+		if queue.opts.Widen {
+			flags |= persistedWiden
+		}
+		if queue.opts.Defaults != nil {
+			flags |= persistedDefaults
+		}
+		buf.WriteByte(flags)
+		if queue.opts.Defaults != nil {
+			writeUint32(&buf, uint32(len(queue.opts.Defaults.Payload)))
+			buf.Write(queue.opts.Defaults.Payload)
+		}
+		writeUint32(&buf, uint32(len(queue.messages)))
+		for _, msg := range queue.messages {
+			writeUint32(&buf, uint32(len(msg)))
+			buf.Write(msg)
+		}
+	}
+	return buf.Bytes()
+}
+
+func deserializeQueues(raw []byte) ([]persistedQueue, error) {
+	reader := bytes.NewReader(raw)
+	noQueues, err := readUint32(reader)
+	if err != nil {
+		return nil, err
+	}
+	queues := make([]persistedQueue, 0, noQueues)
+	for i := uint32(0); i < noQueues; i++ {
+		typLen, err := readUint32(reader)
+		if err != nil {
+			return nil, err
+		}
+		if typLen < 4 || int(typLen-4) > reader.Len() {
+			return nil, errors.New("type too short")
+		}
+		typRaw := make([]byte, typLen)
+		binary.BigEndian.PutUint32(typRaw, typLen)
+		_, _ = reader.Read(typRaw[4:])
+		typ, err := types.Deserialize(typRaw)
+		if err != nil {
+			return nil, err
+		}
+		flags, err := reader.ReadByte()
+		if err != nil {
+			return nil, errors.New("missing option flags")
+		}
+		if flags&^(persistedWiden|persistedDefaults) != 0 {
+			return nil, fmt.Errorf("unknown option flags %d", flags)
+		}
+		queue := persistedQueue{typ: typ, opts: AcceptOptions{Widen: flags&persistedWiden != 0}}
+		if flags&persistedDefaults != 0 {
+			if queue.opts.Defaults, err = readDefaults(reader, typ); err != nil {
+				return nil, err
+			}
+		}
+		noMessages, err := readUint32(reader)
+		if err != nil {
+			return nil, err
+		}
+		for j := uint32(0); j < noMessages; j++ {
+			msgLen, err := readUint32(reader)
+			if err != nil {
+				return nil, err
+			}
+			if int(msgLen) > reader.Len() {
+				return nil, errors.New("message too short")
+			}
+			msg := make([]byte, msgLen)
+			_, _ = reader.Read(msg)
+			queue.messages = append(queue.messages, msg)
+		}
+		queues = append(queues, queue)
+	}
+	if reader.Len() != 0 {
+		return nil, errors.New("trailing data")
+	}
+	return queues, nil
+}
+
+// readDefaults Reads the length prefixed payload of the defaults of typ
+func readDefaults(reader *bytes.Reader, typ types.Type) (*types.Defaults, error) {
+	structType, isStruct := typ.(types.StructType)
+	if !isStruct {
+		return nil, errors.New("defaults for a type other than a struct")
+	}
+	payloadLen, err := readUint32(reader)
+	if err != nil {
+		return nil, err
+	}
+	if int(payloadLen) > reader.Len() {
+		return nil, errors.New("defaults too short")
+	}
+	payload := make([]byte, payloadLen)
+	_, _ = reader.Read(payload)
+	return types.CreateDefaults(structType, payload)
+}
+
+func writeUint32(buf *bytes.Buffer, value uint32) {
+	raw := make([]byte, 4)
+	binary.BigEndian.PutUint32(raw, value)
+	buf.Write(raw)
+}
+
+func readUint32(reader *bytes.Reader) (uint32, error) {
+	raw := make([]byte, 4)
+	if n, _ := reader.Read(raw); n != 4 {
+		return 0, errors.New("too short")
+	}
+	return binary.BigEndian.Uint32(raw), nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
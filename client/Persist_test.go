@@ -0,0 +1,211 @@
+package client
+
+import (
+	"bytes"
+	"github.com/adrianleh/WTMP-middleend/quota"
+	"github.com/adrianleh/WTMP-middleend/types"
+	"github.com/google/uuid"
+	"testing"
+)
+
+func TestPersistRestore(t *testing.T) {
+	dir := t.TempDir()
+	path := callbackListener(t)
+	typ := types.StructType{Fields: []types.Type{types.Int32Type{}, types.BoolType{}}}
+	messages := [][]byte{{0, 0, 0, 1, 1}, {0, 0, 0, 2, 0}}
+
+	clients := CreateClientMap()
+	cl, err := clients.CreateClient(uuid.New(), path, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if err := clients.Add(&cl); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.RegisterType(typ); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range messages {
+		if err := cl.Push(typ, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := clients.Persist(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restart during which alice does not register again must not lose her queues
+	restarted := CreateClientMap()
+	if err := restarted.LoadPersisted(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.Persist(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := CreateClientMap()
+	if err := restored.LoadPersisted(dir); err != nil {
+		t.Fatal(err)
+	}
+	again, err := restored.CreateClient(uuid.New(), path, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if err := restored.Add(&again); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range messages {
+		msg, err := again.Pop(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, expected) {
+			t.Errorf("Expected %v, got %v", expected, msg)
+		}
+	}
+	if empty, _ := again.Empty(typ); !empty {
+		t.Error("Expected the restored queue to be empty")
+	}
+}
+
+func TestRestoreDropsExcess(t *testing.T) {
+	dir := t.TempDir()
+	path := callbackListener(t)
+	typ := types.Int32Type{}
+
+	clients := CreateClientMap()
+	cl, err := clients.CreateClient(uuid.New(), path, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	_ = clients.Add(&cl)
+	_ = cl.RegisterType(typ)
+	_ = cl.RegisterType(types.Int64Type{})
+	_ = cl.Push(typ, []byte{0, 0, 0, 1})
+	_ = cl.Push(typ, []byte{0, 0, 0, 2})
+	if err := clients.Persist(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := CreateClientMap()
+	if err := restored.LoadPersisted(dir); err != nil {
+		t.Fatal(err)
+	}
+	restored.SetLimits(quota.Limits{MaxQueuedBytes: 4, MaxAcceptedTypes: 1})
+	again, err := restored.CreateClient(uuid.New(), path, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if err := restored.Add(&again); err != nil {
+		t.Fatalf("Expected lowered limits not to keep the client from registering, got %v", err)
+	}
+	if accepted := again.GetAcceptedTypes(); len(accepted) != 1 || !types.Same(accepted[0], typ) {
+		t.Errorf("Expected only the first queue to be restored, got %v", accepted)
+	}
+	if msg, err := again.Pop(typ); err != nil || !bytes.Equal(msg, []byte{0, 0, 0, 1}) {
+		t.Errorf("Expected the first message to be restored, got %v (%v)", msg, err)
+	}
+	if empty, _ := again.Empty(typ); !empty {
+		t.Error("Expected the message beyond max_queued_bytes to be dropped")
+	}
+	if stats := again.Stats(); stats.QuotaViolations != 0 {
+		t.Errorf("Expected dropping restored messages not to count as a quota violation, got %d", stats.QuotaViolations)
+	}
+}
+
+func TestRestoredOptions(t *testing.T) {
+	dir := t.TempDir()
+	path := callbackListener(t)
+	typ := types.Int64Type{}
+
+	clients := CreateClientMap()
+	cl, err := clients.CreateClient(uuid.New(), path, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	_ = clients.Add(&cl)
+	if err := cl.RegisterTypeWithOptions(typ, AcceptOptions{Widen: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := clients.Persist(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := CreateClientMap()
+	if err := restored.LoadPersisted(dir); err != nil {
+		t.Fatal(err)
+	}
+	again, err := restored.CreateClient(uuid.New(), path, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if err := restored.Add(&again); err != nil {
+		t.Fatal(err)
+	}
+	if err := again.Push(types.Int32Type{}, []byte{0, 0, 0, 1}); err != nil {
+		t.Errorf("Expected the restored queue to still widen, got %v", err)
+	}
+
+	if err := again.RegisterType(typ); err != nil {
+		t.Errorf("Expected accepting a restored type again to succeed, got %v", err)
+	}
+	if err := again.Push(types.Int32Type{}, []byte{0, 0, 0, 2}); err == nil {
+		t.Error("Expected accepting the type again to replace its options")
+	}
+	if msg, err := again.Pop(typ); err != nil || !bytes.Equal(msg, []byte{0, 0, 0, 0, 0, 0, 0, 1}) {
+		t.Errorf("Expected the widened message to be kept, got %v (%v)", msg, err)
+	}
+	if err := again.RegisterType(typ); err == nil {
+		t.Error("Expected accepting a type twice to fail")
+	}
+}
+
+func TestRestoredDefaults(t *testing.T) {
+	dir := t.TempDir()
+	path := callbackListener(t)
+	older := types.StructType{Fields: []types.Type{types.Int32Type{}}}
+	typ := types.StructType{Fields: []types.Type{types.Int32Type{}, types.BoolType{}}}
+	defaults, err := types.CreateDefaults(typ, []byte{0, 0, 0, 0, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients := CreateClientMap()
+	cl, err := clients.CreateClient(uuid.New(), path, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	_ = clients.Add(&cl)
+	if err := cl.RegisterTypeWithOptions(typ, AcceptOptions{Defaults: defaults}); err != nil {
+		t.Fatal(err)
+	}
+	if err := clients.Persist(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := CreateClientMap()
+	if err := restored.LoadPersisted(dir); err != nil {
+		t.Fatal(err)
+	}
+	again, err := restored.CreateClient(uuid.New(), path, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if err := restored.Add(&again); err != nil {
+		t.Fatal(err)
+	}
+	if err := again.Push(older, []byte{0, 0, 0, 7}); err != nil {
+		t.Fatalf("Expected the restored queue to still extend older messages, got %v", err)
+	}
+	if msg, err := again.Pop(typ); err != nil || !bytes.Equal(msg, []byte{0, 0, 0, 7, 1}) {
+		t.Errorf("Expected the default to be filled in, got %v (%v)", msg, err)
+	}
+}
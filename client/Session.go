@@ -0,0 +1,135 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"net"
+	"time"
+)
+
+// session lets a client registered as resumable reclaim its name, accepted types and queues from another process
+type session struct {
+	token      uuid.UUID
+	detachedAt time.Time // Zero while a connection of the client is open, guarded by the ClientMap's mutex
+}
+
+// SetSessionExpiry Sets how long a detached resumable client is kept before it is removed
+func (clients *ClientMap) SetSessionExpiry(expiry time.Duration) {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+	clients.sessionExpiry = expiry
+}
+
+// AddResumable Adds client like Add and returns the token to resume its session with
+func (clients *ClientMap) AddResumable(client *Client) (uuid.UUID, error) {
+	token := uuid.New()
+	client.session = &session{token: token}
+	if err := clients.Add(client); err != nil {
+		client.session = nil
+		return uuid.Nil, err
+	}
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+	clients.sessions[token] = client
+	return token, nil
+}
+
+// SessionClient Returns the client holding token, nil if there is none
+func (clients *ClientMap) SessionClient(token uuid.UUID) *Client {
+	clients.mutex.RLock()
+	defer clients.mutex.RUnlock()
+	return clients.sessions[token]
+}
+
+// Resume Hands the detached client holding token over to the caller: it is re-keyed to id, bound to peer and
+// its callback socket is replaced by sock, a connection to socketPath. sock is left open on failure. Callers
+// should hold the client's command mutex so no command of the client runs meanwhile.
+func (clients *ClientMap) Resume(token uuid.UUID, id uuid.UUID, socketPath string, sock net.Conn, peer *Peer) (*Client, error) {
+	cl, expired, err := clients.resume(token, id, socketPath, sock, peer)
+	if expired != nil {
+		expired.Close() // Outside the map's lock, closing can block for the write timeout
+	}
+	return cl, err
+}
+
+// resume Does the work of Resume under the map's lock, returning the expired client to close instead of closing it
+func (clients *ClientMap) resume(token uuid.UUID, id uuid.UUID, socketPath string, sock net.Conn, peer *Peer) (*Client, *Client, error) {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+	cl := clients.sessions[token]
+	if cl == nil {
+		return nil, nil, errors.New("unknown resume token")
+	}
+	sess := cl.session
+	if clients.isExpired(sess, time.Now()) {
+		clients.removeLocked(cl)
+		return nil, cl, errors.New("session expired")
+	}
+	if sess.detachedAt.IsZero() {
+		return nil, nil, errors.New("session is still attached")
+	}
+	if other := clients.uuidClientMap[id]; other != nil && other != cl {
+		return nil, nil, fmt.Errorf("client with id \"%s\" already exists", id.String())
+	}
+
+	delete(clients.uuidClientMap, cl.GetId())
+	clients.uuidClientMap[id] = cl
+	sess.detachedAt = time.Time{}
+
+	cl.sockMutex.Lock()
+	cl.id = id
+	cl.peer = peer
+	oldOut := cl.out
+	cl.out = newOutbound(sock, clients.outboundQueueLength, clients.writeTimeout)
+	cl.socketPath = socketPath
+	cl.sockMutex.Unlock()
+	oldOut.abort()
+	return cl, nil, nil
+}
+
+// Detach Marks a resumable client as disconnected so its session starts to expire, other clients are unaffected
+func (clients *ClientMap) Detach(id uuid.UUID) {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+	if cl := clients.uuidClientMap[id]; cl != nil && cl.session != nil && cl.session.detachedAt.IsZero() {
+		cl.session.detachedAt = time.Now()
+	}
+}
+
+// Detached Tells whether the client with id is a resumable client whose connection closed, so it can be resumed
+func (clients *ClientMap) Detached(id uuid.UUID) bool {
+	clients.mutex.RLock()
+	defer clients.mutex.RUnlock()
+	cl := clients.uuidClientMap[id]
+	return cl != nil && cl.session != nil && !cl.session.detachedAt.IsZero()
+}
+
+func (clients *ClientMap) isExpired(sess *session, now time.Time) bool {
+	return clients.sessionExpiry > 0 && !sess.detachedAt.IsZero() && now.Sub(sess.detachedAt) > clients.sessionExpiry
+}
+
+// RemoveExpired Removes resumable clients that have been detached for longer than the session expiry
+func (clients *ClientMap) RemoveExpired() []*Client {
+	expired := clients.removeExpired()
+	for _, cl := range expired {
+		cl.Close() // Outside the map's lock, closing can block for the write timeout
+	}
+	return expired
+}
+
+func (clients *ClientMap) removeExpired() []*Client {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+	now := time.Now()
+	var expired []*Client
+	for _, cl := range clients.uuidClientMap {
+		if cl.session != nil && clients.isExpired(cl.session, now) {
+			expired = append(expired, cl)
+		}
+	}
+	for _, cl := range expired {
+		clients.removeLocked(cl)
+	}
+	return expired
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"github.com/adrianleh/WTMP-middleend/quota"
+	"sync/atomic"
+)
+
+type Stats struct {
+	Name            string
+	Peer            string
+	AcceptedTypes   int
+	QueuedMessages  int
+	QueuedBytes     uint64
+	QuotaViolations uint64
+}
+
+func (cl *Client) Stats() Stats {
+	acceptedTypes := cl.GetAcceptedTypes()
+	queuedMessages := 0
+	for _, typ := range acceptedTypes {
+		queuedMessages += cl.queue(typ).Len()
+	}
+	return Stats{
+		Name:            cl.name,
+		Peer:            cl.GetPeer().String(),
+		AcceptedTypes:   len(acceptedTypes),
+		QueuedMessages:  queuedMessages,
+		QueuedBytes:     atomic.LoadUint64(&cl.queuedBytes),
+		QuotaViolations: atomic.LoadUint64(&cl.quotaViolations),
+	}
+}
+
+// AllowSend Charges a message of size bytes sent by this client against its rate limits
+func (cl *Client) AllowSend(size uint64) error {
+	if err := cl.sendLimiter.Allow(size); err != nil {
+		atomic.AddUint64(&cl.quotaViolations, 1)
+		return err
+	}
+	return nil
+}
+
+// CheckSend Tells whether messages of sizes sent by this client are within its rate limits, without charging them
+func (cl *Client) CheckSend(sizes ...uint64) error {
+	if err := cl.sendLimiter.Check(sizes...); err != nil {
+		atomic.AddUint64(&cl.quotaViolations, 1)
+		return err
+	}
+	return nil
+}
+
+// ChargeSend Charges messages of sizes, sent by this client after CheckSend allowed them, against its rate limits
+func (cl *Client) ChargeSend(sizes ...uint64) {
+	cl.sendLimiter.Take(sizes...)
+}
+
+func (cl *Client) quotaExceeded(name string) error {
+	atomic.AddUint64(&cl.quotaViolations, 1)
+	return quota.Exceeded(name)
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"errors"
+	"github.com/adrianleh/WTMP-middleend/messagequeue"
+	"github.com/adrianleh/WTMP-middleend/types"
+	"sort"
+	"sync/atomic"
+)
+
+// Delivery is a message checked by Prepare, ready to be delivered together with others by Deliver
+type Delivery struct {
+	cl    *Client
+	queue *messagequeue.MessageQueue
+	data  []byte // Trimmed to the type of queue
+}
+
+// Prepare Checks that cl accepts data of typ and trims it for the accepting queue, without pushing it
+func (cl *Client) Prepare(typ types.Type, data []byte) (Delivery, error) {
+	superType, superFp, err := cl.acceptingSuperType(typ, types.FingerprintOf(typ))
+	if err != nil {
+		return Delivery{}, err
+	}
+	trimmedData, err := cl.trim(typ, superType, superFp, data)
+	if err != nil {
+		return Delivery{}, err
+	}
+	return Delivery{cl: cl, queue: cl.queueOf(superFp), data: trimmedData}, nil
+}
+
+// Deliver Pushes all deliveries or none of them. The receivers are locked in name order and their queue lengths
+// and queued bytes are checked before the first push, so no receiver ever observes part of the deliveries.
+func Deliver(deliveries []Delivery) error {
+	var receivers []*Client
+	messages := map[*messagequeue.MessageQueue]uint64{}
+	bytes := map[*Client]uint64{}
+	for _, delivery := range deliveries {
+		if _, ok := bytes[delivery.cl]; !ok {
+			receivers = append(receivers, delivery.cl)
+		}
+		messages[delivery.queue]++
+		bytes[delivery.cl] += uint64(len(delivery.data))
+	}
+	sort.Slice(receivers, func(i, j int) bool { return receivers[i].name < receivers[j].name })
+	for _, cl := range receivers {
+		cl.deliveryMutex.Lock()
+		defer cl.deliveryMutex.Unlock()
+	}
+
+	for queue, count := range messages {
+		if !queue.Fits(count) {
+			return errors.New("queue full")
+		}
+	}
+	for _, cl := range receivers {
+		if max := cl.limits.MaxQueuedBytes; max != 0 && atomic.LoadUint64(&cl.queuedBytes)+bytes[cl] > max {
+			return cl.quotaExceeded("max_queued_bytes")
+		}
+	}
+
+	for _, delivery := range deliveries {
+		cl := delivery.cl
+		if err := delivery.queue.PushSequenced(delivery.data, atomic.AddUint64(&cl.arrivals, 1)); err != nil {
+			return err // Cannot happen, sizes are checked by Prepare and lengths above
+		}
+		atomic.AddUint64(&cl.queuedBytes, uint64(len(delivery.data)))
+	}
+	for _, cl := range receivers {
+		cl.signalArrival()
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
+	"github.com/adrianleh/WTMP-middleend/broker"
+	"github.com/adrianleh/WTMP-middleend/config"
+	"github.com/adrianleh/WTMP-middleend/logging"
+	"github.com/adrianleh/WTMP-middleend/policy"
+	"github.com/adrianleh/WTMP-middleend/presence"
+	"github.com/adrianleh/WTMP-middleend/socket"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func main() {
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	level, _ := logging.ParseLevel(cfg.LogLevel) // Already validated
+	logging.SetLevel(level)
+
+	opts := brokerOptions(cfg)
+	if cfg.PolicyFile != "" {
+		p, err := loadPolicy(cfg) // Loaded once, here rather than in cfg.Validate
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "policy_file: %v\n", err)
+			os.Exit(2)
+		}
+		opts = append(opts, broker.WithPolicy(p))
+	}
+	b, err := broker.New(opts...)
+	if err != nil {
+		logging.Errorf("Failed to start: %v", err)
+		os.Exit(1)
+	}
+	listeners, ownedPaths, err := startServer(cfg)
+	if err != nil {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		removeSockets(ownedPaths)
+		logging.Errorf("Failed to start: %v", err)
+		os.Exit(1)
+	}
+	shutdownOnSignal(b, cfg.ShutdownTimeout, ownedPaths)
+
+	if cfg.MetricsAddr != "" {
+		expvar.Publish("clients", expvar.Func(func() interface{} { return b.Stats() }))
+		go serveMetrics(cfg.MetricsAddr)
+	}
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			if err := b.Serve(listener); err != broker.ErrBrokerClosed {
+				log.Fatal("accept error:", err)
+			}
+		}(listener)
+	}
+	select {} // shutdownOnSignal exits the process
+}
+
+func brokerOptions(cfg config.Config) []broker.Option {
+	deadClientPolicy, _ := presence.ParseDeadClientPolicy(cfg.DeadClientPolicy) // Already validated
+	return []broker.Option{
+		broker.WithHeartbeat(cfg.HeartbeatInterval, cfg.HeartbeatMissed),
+		broker.WithDeadClientPolicy(deadClientPolicy),
+		broker.WithMaxMessageSize(cfg.MaxMessageSize),
+		broker.WithMaxQueueLength(cfg.MaxQueueLength),
+		broker.WithLimits(cfg.Limits),
+		broker.WithSessionExpiry(cfg.SessionExpiry),
+		broker.WithPersistenceDir(cfg.PersistenceDir),
+		broker.WithOutbound(cfg.OutboundQueueLength, cfg.WriteTimeout),
+		broker.WithPayloadValidation(cfg.ValidatePayloads),
+	}
+}
+
+// loadPolicy Loads the policy file and directs its audit log to the configured file, if any
+func loadPolicy(cfg config.Config) (*policy.Policy, error) {
+	p, err := policy.Load(cfg.PolicyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.AuditLog != "" {
+		auditFile, err := os.OpenFile(cfg.AuditLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		p.SetAuditLog(auditFile)
+	}
+	return p, nil
+}
+
+// loadConfig Builds the config from defaults, the config file, WTMP_* environment variables and flags,
+// each overriding the previous
+func loadConfig(args []string) (config.Config, error) {
+	flags := flag.NewFlagSet("wtmpd", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv(config.EnvPrefix+"CONFIG"), "path to a JSON or key=value config file")
+	for _, key := range config.Keys {
+		flags.String(flagName(key), "", "overrides config key "+key)
+	}
+	if err := flags.Parse(args); err != nil {
+		return config.Config{}, err
+	}
+
+	cfg := config.Default()
+	if *configPath != "" {
+		loaded, err := config.Load(*configPath)
+		if err != nil {
+			return cfg, err
+		}
+		cfg = loaded
+	}
+	if err := cfg.ApplyEnv(os.LookupEnv); err != nil {
+		return cfg, err
+	}
+	var flagErr error
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "config" || flagErr != nil {
+			return
+		}
+		flagErr = cfg.Set(strings.ReplaceAll(f.Name, "-", "_"), f.Value.String())
+	})
+	if flagErr != nil {
+		return cfg, flagErr
+	}
+	return cfg, cfg.Validate()
+}
+
+func flagName(key string) string {
+	return strings.ReplaceAll(key, "_", "-")
+}
+
+func serveMetrics(addr string) {
+	// expvar registers itself on the default mux under /debug/vars
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		logging.Errorf("metrics server failed: %v", err)
+	}
+}
+
+// startServer Uses the sockets passed by socket activation if there are any, otherwise listens on the configured paths.
+// Returns the socket files the broker created itself and thus has to remove on exit.
+func startServer(cfg config.Config) ([]net.Listener, []string, error) {
+	activated, err := socket.ActivationListeners()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(activated) > 0 {
+		logging.Infof("Using %d socket activated listener(s)", len(activated))
+		return activated, nil, nil
+	}
+	perm := socket.Permissions{
+		Mode:  cfg.SocketMode,
+		Owner: cfg.SocketOwner,
+		Group: cfg.SocketGroup,
+	}
+	listeners := make([]net.Listener, 0, len(cfg.SocketPaths))
+	var ownedPaths []string
+	for _, path := range cfg.SocketPaths {
+		listener, err := socket.Listen(path, perm)
+		if err != nil {
+			return listeners, ownedPaths, err
+		}
+		listeners = append(listeners, listener)
+		if !socket.IsAbstract(path) {
+			ownedPaths = append(ownedPaths, path)
+		}
+	}
+	return listeners, ownedPaths, nil
+}
+
+func removeSockets(sockPaths []string) error {
+	var lastErr error
+	for _, sockPath := range sockPaths {
+		if err := os.Remove(sockPath); err != nil && !os.IsNotExist(err) {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// shutdownOnSignal Shuts down gracefully on the first SIGINT/SIGTERM and exits immediately on the second one
+// or once timeout has passed
+func shutdownOnSignal(b *broker.Broker, timeout time.Duration, ownedPaths []string) {
+	signalChannel := make(chan os.Signal, 2)
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signalChannel
+		logging.Infof("Shutting down, waiting up to %s", timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		go func() {
+			<-signalChannel
+			logging.Warnf("Forced exit")
+			cancel()
+		}()
+		exitCode := 0
+		if err := b.Shutdown(ctx); err != nil {
+			logging.Errorf("Shutdown incomplete: %v", err)
+			exitCode = 3
+		}
+		if err := removeSockets(ownedPaths); err != nil && exitCode == 0 {
+			exitCode = 3
+		}
+		os.Exit(exitCode)
+	}()
+}
@@ -1,26 +1,42 @@
 package command
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/adrianleh/WTMP-middleend/client"
 	"github.com/adrianleh/WTMP-middleend/types"
 )
 
+const (
+	// AcceptWidening is the flag letting messages of narrower numeric types be widened into the accepted type
+	AcceptWidening = uint8(1)
+	// AcceptDefaults is the flag for a struct whose default values follow the flags as a payload of the struct, used
+	// to extend messages of older versions of the struct lacking its trailing fields
+	AcceptDefaults = uint8(2)
+)
+
+// AcceptTypeCommandHandler Registers a queue for a type.
+// Data is the serialized type, optionally followed by a flags byte made of AcceptWidening and AcceptDefaults.
 type AcceptTypeCommandHandler struct{}
 
 func (AcceptTypeCommandHandler) Handle(frame *CommandFrame) error {
-	typ, err := types.Deserialize(frame.Data)
+	typ, opts, err := parseAcceptTypeData(frame.Env.Clients, frame.Data)
 	if err != nil {
 		return err
 	}
 
-	cl := client.Clients.GetById(frame.ClientId)
+	cl := frame.Env.Clients.GetById(frame.ClientId)
 	if cl == nil {
 		return errors.New("client not found")
 	}
-	err = cl.RegisterType(typ)
+	err = frame.Env.Policy.AuthorizeAcceptType(cl.GetName(), typ)
+	if err == nil {
+		err = cl.RegisterTypeWithOptions(typ, opts)
+	}
 	ret := []byte{0}
 	if err != nil {
+		notifyRejection(cl, err)
 		ret[0] = 1
 	}
 	sendErr := cl.SendToClient(ret)
@@ -29,3 +45,40 @@ func (AcceptTypeCommandHandler) Handle(frame *CommandFrame) error {
 	}
 	return err
 }
+
+func parseAcceptTypeData(clients *client.ClientMap, data []byte) (types.Type, client.AcceptOptions, error) {
+	if len(data) < 4 {
+		return nil, client.AcceptOptions{}, errors.New("type too short")
+	}
+	// Types are length prefixed, what follows is the flags
+	typLen := uint64(binary.BigEndian.Uint32(data[0:4]))
+	var flags uint8
+	var rest []byte
+	if uint64(len(data)) > typLen {
+		flags = data[typLen]
+		rest = data[typLen+1:]
+		data = data[:typLen]
+	}
+	if flags&^(AcceptWidening|AcceptDefaults) != 0 {
+		return nil, client.AcceptOptions{}, fmt.Errorf("unknown accept flags %d", flags)
+	}
+	typ, err := clients.DeserializeType(data)
+	if err != nil {
+		return nil, client.AcceptOptions{}, err
+	}
+	opts := client.AcceptOptions{Widen: flags&AcceptWidening != 0}
+	if flags&AcceptDefaults == 0 {
+		if len(rest) != 0 {
+			return nil, client.AcceptOptions{}, fmt.Errorf("%d bytes after the flags", len(rest))
+		}
+		return typ, opts, nil
+	}
+	structType, isStruct := typ.(types.StructType)
+	if !isStruct {
+		return nil, client.AcceptOptions{}, errors.New("defaults are only supported for structs")
+	}
+	if opts.Defaults, err = types.CreateDefaults(structType, rest); err != nil {
+		return nil, client.AcceptOptions{}, err
+	}
+	return typ, opts, nil
+}
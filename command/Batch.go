@@ -0,0 +1,134 @@
+package command
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/adrianleh/WTMP-middleend/client"
+	"github.com/adrianleh/WTMP-middleend/logging"
+	"github.com/adrianleh/WTMP-middleend/policy"
+	"github.com/adrianleh/WTMP-middleend/quota"
+)
+
+// Results of the items of a SendBatch
+const (
+	BatchItemSent      = byte(0)
+	BatchItemFailed    = byte(1)
+	BatchItemDenied    = byte(2)
+	BatchItemOverQuota = byte(3)
+	// BatchItemAborted is the result of valid items of a transaction that failed as a whole
+	BatchItemAborted = byte(4)
+)
+
+// SendBatchCommandHandler Sends several messages in one frame.
+// Data is the number of items (4) followed by each item's length (4) and the item, which is laid out like the data
+// of a Send. A registered sender receives the number of items (4) followed by one result byte per item, instead of
+// the notifications a denied or over quota Send gets.
+type SendBatchCommandHandler struct{}
+
+func (SendBatchCommandHandler) Handle(frame *CommandFrame) error {
+	items, err := batchItems(frame.Data)
+	if err != nil {
+		return err
+	}
+
+	sender := frame.Env.Clients.GetById(frame.ClientId)
+	response := make([]byte, 4, 4+len(items))
+	binary.BigEndian.PutUint32(response, uint32(len(items)))
+	for i, item := range items {
+		result := BatchItemSent
+		content, err := sendData(frame.Env.Clients, item)
+		if err == nil {
+			err = deliver(frame, sender, content) // The result byte reports a failure, no notification
+		}
+		if err != nil {
+			result = batchItemResult(err)
+			logging.Debugf("Item %d of batch from %s failed: %v", i, frame.ClientId, err)
+		}
+		response = append(response, result)
+	}
+	if sender == nil {
+		return nil
+	}
+	return sender.SendToClient(response)
+}
+
+func batchItemResult(err error) byte {
+	var denied *policy.DeniedError
+	var exceeded *quota.ExceededError
+	switch {
+	case errors.As(err, &denied):
+		return BatchItemDenied
+	case errors.As(err, &exceeded):
+		return BatchItemOverQuota
+	}
+	return BatchItemFailed
+}
+
+func batchItems(data []byte) ([][]byte, error) {
+	if len(data) < 4 {
+		return nil, errors.New("data must hold the number of items")
+	}
+	noItems := binary.BigEndian.Uint32(data[0:4])
+	data = data[4:]
+	if uint64(noItems)*4 > uint64(len(data)) {
+		return nil, errors.New("data too short for the number of items")
+	}
+	items := make([][]byte, 0, noItems)
+	for i := uint32(0); i < noItems; i++ {
+		if len(data) < 4 {
+			return nil, errors.New("missing item length")
+		}
+		itemLen := binary.BigEndian.Uint32(data[0:4])
+		if uint64(itemLen) > uint64(len(data)-4) {
+			return nil, errors.New("item too short")
+		}
+		items = append(items, data[4:4+itemLen])
+		data = data[4+itemLen:]
+	}
+	if len(data) != 0 {
+		return nil, errors.New("trailing data after items")
+	}
+	return items, nil
+}
+
+// GetBatchCommandHandler Pops up to a maximum number of messages of a type in one response.
+// Data is the maximum (4) followed by the serialized type. The response is the number of messages popped (4)
+// followed by each message's length (4) and the message, oldest first.
+type GetBatchCommandHandler struct{}
+
+func (GetBatchCommandHandler) Handle(frame *CommandFrame) error {
+	if len(frame.Data) < 4 {
+		return errors.New("data must hold the maximum number of messages")
+	}
+	max := binary.BigEndian.Uint32(frame.Data[0:4])
+	typ, err := frame.Env.Clients.DeserializeType(frame.Data[4:])
+	if err != nil {
+		return err
+	}
+
+	cl := frame.Env.Clients.GetById(frame.ClientId)
+	if cl == nil {
+		return errors.New("client not found")
+	}
+	if err := frame.Env.Policy.AuthorizeGet(cl.GetName(), typ); err != nil {
+		_ = cl.Notify(client.DeniedNotification, []byte(err.Error()))
+		return err
+	}
+	if _, err := cl.Empty(typ); err != nil {
+		return err // Not an accepted type
+	}
+
+	response := make([]byte, 4)
+	count := uint32(0)
+	for ; count < max; count++ {
+		data, err := cl.Pop(typ)
+		if err != nil {
+			break // Drained the queue
+		}
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(data)))
+		response = append(append(response, length...), data...)
+	}
+	binary.BigEndian.PutUint32(response[0:4], count)
+	return cl.SendToClient(response)
+}
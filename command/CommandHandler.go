@@ -5,7 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"github.com/adrianleh/WTMP-middleend/client"
+	"github.com/adrianleh/WTMP-middleend/policy"
+	"github.com/adrianleh/WTMP-middleend/quota"
 	"github.com/google/uuid"
+	"sync"
 )
 
 type Handler interface {
@@ -23,6 +26,66 @@ type CommandFrame struct {
 	CommandId uint8
 	Size      uint64
 	Data      []byte
+	Env       *Env
+	Conn      *Conn
+	// commandMutex is the client's command mutex while Submit holds it for the frame
+	commandMutex *sync.Mutex
+}
+
+// unlocked Runs wait with the client's command mutex released, so a command blocking in wait does not stall the
+// client's other commands. The mutex is held again once unlocked returns.
+func (frame *CommandFrame) unlocked(wait func()) {
+	if frame.commandMutex != nil {
+		frame.commandMutex.Unlock()
+		defer frame.commandMutex.Lock()
+	}
+	wait()
+}
+
+// Conn is the state of the connection a frame arrived on
+type Conn struct {
+	Peer        *client.Peer       // nil if the peer credentials could not be determined
+	SendLimiter *quota.SendLimiter // Rate limits sends of clients that have not registered
+	clientIds   []uuid.UUID        // Resumable clients registered or resumed through this connection
+}
+
+// bind Remembers that the resumable client id lives on this connection. Frames of a connection are handled
+// one after another, so no locking is needed.
+func (conn *Conn) bind(id uuid.UUID) {
+	if conn != nil {
+		conn.clientIds = append(conn.clientIds, id)
+	}
+}
+
+// ClientIds Lists the resumable clients to detach once the connection closes
+func (conn *Conn) ClientIds() []uuid.UUID { return conn.clientIds }
+
+// Peer Returns the process that sent the frame, nil if unknown
+func (frame *CommandFrame) Peer() *client.Peer {
+	if frame.Conn == nil {
+		return nil
+	}
+	return frame.Conn.Peer
+}
+
+// Env is the broker state commands are executed against
+type Env struct {
+	Clients  *client.ClientMap
+	Registry *Registry
+	Policy   *policy.Policy  // nil allows everything
+	Done     <-chan struct{} // Closed when the broker shuts down, ends blocking commands. nil never closes.
+	// ValidatePayloads Rejects sent messages that are not valid values of their type, see types.Validate
+	ValidatePayloads bool
+	// AuthenticatePeers Makes Submit reject commands of registered clients sent by another process than the one that
+	// registered them before waiting for the client's command mutex, like PeerAuthMiddleware
+	AuthenticatePeers bool
+}
+
+func CreateEnv(clients *client.ClientMap) *Env {
+	return &Env{
+		Clients:  clients,
+		Registry: DefaultRegistry(),
+	}
 }
 
 func getClientId(rawFrame []byte) (uuid.UUID, error) {
@@ -73,23 +136,40 @@ const (
 	SendCommandId            = uint8(3)
 	GetCommandId             = uint8(4)
 	EmptyCommandId           = uint8(5)
+	// RegisterResumableCommandId registers like RegisterCommandId, a successful response carries a 16 byte resume token
+	RegisterResumableCommandId = uint8(6)
+	ResumeCommandId            = uint8(7)
+	PingCommandId              = uint8(8)
+	GetAnyCommandId            = uint8(9)
+	SendBatchCommandId         = uint8(10)
+	GetBatchCommandId          = uint8(11)
+	SendTransactionCommandId   = uint8(12)
 )
 
-func Submit(rawFrame []byte) error {
+func (env *Env) Submit(conn *Conn, rawFrame []byte) error {
 	clientId, err := getClientId(rawFrame) // For faster locking
 	if err != nil {
 		return err
 	}
-	cl := client.Clients.GetById(clientId)
+	frame, err := parseCommandFrame(rawFrame)
+	if err != nil {
+		return err
+	}
+	frame.Env = env
+	frame.Conn = conn
+
+	cl := env.Clients.GetById(clientId)
+	if cl != nil && env.AuthenticatePeers {
+		// Before locking, so other processes cannot stall the client by holding its command mutex
+		if err := authenticatePeer(cl, &frame); err != nil {
+			return &handlerError{frame: &frame, cause: err}
+		}
+	}
 	if cl != nil {
 		mutex := cl.GetCommandMutex()
 		mutex.Lock()
 		defer mutex.Unlock()
-	}
-
-	frame, err := parseCommandFrame(rawFrame)
-	if err != nil {
-		return err
+		frame.commandMutex = mutex
 	}
 
 	return frame.Handle()
@@ -105,23 +185,7 @@ func (e *handlerError) Error() string {
 }
 
 func (frame *CommandFrame) Handle() error {
-	//log.Printf("Client %s issued command %d", frame.ClientId.String(), frame.CommandId)
-	var handler Handler
-	switch frame.CommandId {
-	case RegisterCommandId:
-		handler = RegisterCommandHandler{}
-	case AcceptTypeCommandId:
-		handler = AcceptTypeCommandHandler{}
-	case SendCommandId:
-		handler = SendCommandHandler{}
-	case GetCommandId:
-		handler = GetCommandHandler{}
-	case EmptyCommandId:
-		handler = EmptyCommandHandler{}
-	default:
-		handler = DefaultHandler{}
-	}
-	err := handler.Handle(frame)
+	err := frame.Env.Registry.Lookup(frame.CommandId).Handle(frame)
 	if err == nil {
 		return nil
 	}
@@ -0,0 +1,24 @@
+package command
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func FuzzParseCommandFrame(f *testing.F) {
+	header := make([]byte, 25)
+	header[16] = SendCommandId
+	f.Add(header)
+	binary.BigEndian.PutUint64(header[17:25], 3)
+	f.Add(append(header, 1, 2, 3))
+	f.Add([]byte{1, 2, 3})
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		frame, err := parseCommandFrame(raw)
+		if err != nil {
+			return
+		}
+		if uint64(len(frame.Data)) != frame.Size || len(raw) != 25+len(frame.Data) {
+			t.Errorf("Frame of %d bytes parsed with %d bytes of data and size %d", len(raw), len(frame.Data), frame.Size)
+		}
+	})
+}
@@ -2,19 +2,17 @@ package command
 
 import (
 	"errors"
-	"github.com/adrianleh/WTMP-middleend/client"
-	"github.com/adrianleh/WTMP-middleend/types"
 )
 
 type EmptyCommandHandler struct{}
 
 func (EmptyCommandHandler) Handle(frame *CommandFrame) error {
-	typ, err := types.Deserialize(frame.Data)
+	typ, err := frame.Env.Clients.DeserializeType(frame.Data)
 	if err != nil {
 		return err
 	}
 
-	cl := client.Clients.GetById(frame.ClientId)
+	cl := frame.Env.Clients.GetById(frame.ClientId)
 	if cl == nil {
 		return errors.New("client not found")
 	}
@@ -3,21 +3,24 @@ package command
 import (
 	"errors"
 	"github.com/adrianleh/WTMP-middleend/client"
-	"github.com/adrianleh/WTMP-middleend/types"
 )
 
 type GetCommandHandler struct{}
 
 func (GetCommandHandler) Handle(frame *CommandFrame) error {
-	typ, err := types.Deserialize(frame.Data)
+	typ, err := frame.Env.Clients.DeserializeType(frame.Data)
 	if err != nil {
 		return err
 	}
 
-	cl := client.Clients.GetById(frame.ClientId)
+	cl := frame.Env.Clients.GetById(frame.ClientId)
 	if cl == nil {
 		return errors.New("client not found")
 	}
+	if err := frame.Env.Policy.AuthorizeGet(cl.GetName(), typ); err != nil {
+		_ = cl.Notify(client.DeniedNotification, []byte(err.Error()))
+		return err
+	}
 	data, err := cl.Pop(typ)
 	if err != nil {
 		return err
@@ -0,0 +1,105 @@
+package command
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/adrianleh/WTMP-middleend/client"
+	"github.com/adrianleh/WTMP-middleend/types"
+	"time"
+)
+
+// GetAnyCommandHandler Pops the oldest message among several accepted types.
+// Data is a timeout in milliseconds (4), the number of types (4), 0 meaning all accepted types, and the serialized
+// types. If no message is queued the command waits up to the timeout for one to arrive, letting the client's other
+// commands run meanwhile. The response is 0 followed by the serialized type and the message, or 1 if no message
+// arrived in time.
+type GetAnyCommandHandler struct{}
+
+func (GetAnyCommandHandler) Handle(frame *CommandFrame) error {
+	timeout, typs, err := parseGetAnyData(frame.Env.Clients, frame.Data)
+	if err != nil {
+		return err
+	}
+
+	cl := frame.Env.Clients.GetById(frame.ClientId)
+	if cl == nil {
+		return errors.New("client not found")
+	}
+	if typs == nil {
+		for _, typ := range cl.GetAcceptedTypes() {
+			if frame.Env.Policy.AuthorizeGet(cl.GetName(), typ) == nil {
+				typs = append(typs, typ)
+			}
+		}
+		if typs == nil {
+			return cl.SendToClient([]byte{1})
+		}
+	} else {
+		for _, typ := range typs {
+			if err := frame.Env.Policy.AuthorizeGet(cl.GetName(), typ); err != nil {
+				_ = cl.Notify(client.DeniedNotification, []byte(err.Error()))
+				return err
+			}
+		}
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	waiting := time.NewTicker(time.Second) // The client cannot answer heartbeats while its connection waits here
+	defer waiting.Stop()
+	for {
+		arrival := cl.Arrival()
+		typ, data, err := cl.PopOldest(typs)
+		if err == nil {
+			return cl.SendToClient(append(append([]byte{0}, typ.Serialize()...), data...))
+		}
+		if err != client.ErrNoMessage {
+			return err
+		}
+		timedOut := false
+		frame.unlocked(func() {
+			select {
+			case <-arrival:
+			case <-waiting.C:
+				cl.Touch()
+			case <-deadline.C:
+				timedOut = true
+			case <-frame.Env.Done:
+				timedOut = true
+			}
+		})
+		if timedOut {
+			return cl.SendToClient([]byte{1})
+		}
+	}
+}
+
+// parseGetAnyData Returns nil types if all accepted types were requested
+func parseGetAnyData(clients *client.ClientMap, data []byte) (time.Duration, []types.Type, error) {
+	if len(data) < 8 {
+		return 0, nil, errors.New("data must hold a timeout and the number of types")
+	}
+	timeout := time.Duration(binary.BigEndian.Uint32(data[0:4])) * time.Millisecond
+	noTypes := binary.BigEndian.Uint32(data[4:8])
+	data = data[8:]
+	var typs []types.Type
+	for i := uint32(0); i < noTypes; i++ {
+		if len(data) < 4 {
+			return 0, nil, errors.New("missing type")
+		}
+		typLen := binary.BigEndian.Uint32(data[0:4])
+		if typLen < 5 || uint64(typLen) > uint64(len(data)) {
+			return 0, nil, errors.New("invalid type length")
+		}
+		typ, err := clients.DeserializeType(data[:typLen])
+		if err != nil {
+			return 0, nil, err
+		}
+		typs = append(typs, typ)
+		data = data[typLen:]
+	}
+	if len(data) != 0 {
+		return 0, nil, errors.New("trailing data after types")
+	}
+	return timeout, typs, nil
+}
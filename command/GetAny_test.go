@@ -0,0 +1,78 @@
+package command
+
+import (
+	"bytes"
+	"github.com/adrianleh/WTMP-middleend/client"
+	"github.com/adrianleh/WTMP-middleend/types"
+	"github.com/google/uuid"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetAnyWaitsUnlocked(t *testing.T) {
+	cbPath := filepath.Join(t.TempDir(), "cb.sock")
+	callback, err := net.Listen("unix", cbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer callback.Close()
+	clients := client.CreateClientMap()
+	cl, err := client.CreateClient(uuid.New(), cbPath, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if err := clients.Add(&cl); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.RegisterType(types.Int32Type{}); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex := &sync.Mutex{}
+	frame := &CommandFrame{
+		ClientId:     cl.GetId(),
+		CommandId:    GetAnyCommandId,
+		Data:         []byte{0, 0, 0x27, 0x10, 0, 0, 0, 0}, // 10s for any accepted type
+		Env:          &Env{Clients: &clients, Registry: DefaultRegistry()},
+		commandMutex: mutex,
+	}
+	locked := make(chan bool)
+	done := make(chan error, 1)
+	go func() {
+		mutex.Lock() // Like Submit
+		locked <- true
+		done <- GetAnyCommandHandler{}.Handle(frame)
+		mutex.Unlock()
+	}()
+	<-locked
+	mutex.Lock() // Only possible once GetAny waits for an arrival
+	if err := cl.Push(types.Int32Type{}, []byte{0, 0, 0, 7}); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Unlock()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("GetAny should return the message that arrived while it waited")
+	}
+
+	conn, err := callback.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expected := client.EncodeReply(append(append([]byte{0}, types.Int32Type{}.Serialize()...), 0, 0, 0, 7))
+	reply := make([]byte, len(expected))
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, reply); err != nil || !bytes.Equal(reply, expected) {
+		t.Errorf("Expected %v, got %v (%v)", expected, reply, err)
+	}
+}
@@ -0,0 +1,115 @@
+package command
+
+import (
+	"expvar"
+	"fmt"
+	"github.com/adrianleh/WTMP-middleend/client"
+	"github.com/adrianleh/WTMP-middleend/logging"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+var (
+	commandCounts    = expvar.NewMap("commands")
+	commandErrors    = expvar.NewMap("command_errors")
+	commandDurations = expvar.NewMap("command_duration_us")
+)
+
+// LoggingMiddleware Logs every command at debug level
+func LoggingMiddleware(next Handler) Handler {
+	return HandlerFunc(func(frame *CommandFrame) error {
+		logging.Debugf("Client %s issued command %d", frame.ClientId.String(), frame.CommandId)
+		return next.Handle(frame)
+	})
+}
+
+// RecoveryMiddleware Turns a panicking handler into a failed command instead of crashing the broker
+func RecoveryMiddleware(next Handler) Handler {
+	return HandlerFunc(func(frame *CommandFrame) (err error) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				logging.Errorf("Command %d panicked: %v\n%s", frame.CommandId, recovered, debug.Stack())
+				err = fmt.Errorf("handler panicked: %v", recovered)
+			}
+		}()
+		return next.Handle(frame)
+	})
+}
+
+// MetricsMiddleware Counts commands, failures and accumulated handling time per command id in expvar
+func MetricsMiddleware(next Handler) Handler {
+	return HandlerFunc(func(frame *CommandFrame) error {
+		key := strconv.Itoa(int(frame.CommandId))
+		start := time.Now()
+		err := next.Handle(frame)
+		commandCounts.Add(key, 1)
+		commandDurations.Add(key, time.Since(start).Microseconds())
+		if err != nil {
+			commandErrors.Add(key, 1)
+		}
+		return err
+	})
+}
+
+// TimingMiddleware Logs commands taking longer than threshold
+func TimingMiddleware(threshold time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(frame *CommandFrame) error {
+			start := time.Now()
+			err := next.Handle(frame)
+			if elapsed := time.Since(start); elapsed > threshold {
+				logging.Warnf("Command %d from client %s took %s", frame.CommandId, frame.ClientId, elapsed)
+			}
+			return err
+		})
+	}
+}
+
+// AuthMiddleware Rejects every command for which authorize returns an error without running its handler
+func AuthMiddleware(authorize func(frame *CommandFrame) error) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(frame *CommandFrame) error {
+			if err := authorize(frame); err != nil {
+				return err
+			}
+			return next.Handle(frame)
+		})
+	}
+}
+
+// PeerAuthMiddleware Rejects commands of registered clients sent by another process than the one that registered them,
+// so knowing a client's id is not enough to impersonate it. Resuming is authenticated by the resume token instead.
+func PeerAuthMiddleware(next Handler) Handler {
+	return HandlerFunc(func(frame *CommandFrame) error {
+		if cl := frame.Env.Clients.GetById(frame.ClientId); cl != nil {
+			if err := authenticatePeer(cl, frame); err != nil {
+				return err
+			}
+		}
+		return next.Handle(frame)
+	})
+}
+
+// authenticatePeer Fails if frame was sent by another process than the one that registered cl, the process being
+// unknown included
+func authenticatePeer(cl *client.Client, frame *CommandFrame) error {
+	switch frame.CommandId {
+	case RegisterCommandId, RegisterResumableCommandId, ResumeCommandId:
+		return nil
+	}
+	if !cl.GetPeer().SameProcess(frame.Peer()) {
+		return fmt.Errorf("client %s does not belong to %s", cl.Describe(), frame.Peer())
+	}
+	return nil
+}
+
+// LivenessMiddleware Counts every command of a registered client as a sign of life
+func LivenessMiddleware(next Handler) Handler {
+	return HandlerFunc(func(frame *CommandFrame) error {
+		if cl := frame.Env.Clients.GetById(frame.ClientId); cl != nil {
+			cl.Touch()
+		}
+		return next.Handle(frame)
+	})
+}
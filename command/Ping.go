@@ -0,0 +1,15 @@
+package command
+
+import "errors"
+
+// PingCommandHandler Answers a heartbeat of the client with a single 0 byte
+type PingCommandHandler struct{}
+
+func (PingCommandHandler) Handle(frame *CommandFrame) error {
+	cl := frame.Env.Clients.GetById(frame.ClientId)
+	if cl == nil {
+		return errors.New("client not found")
+	}
+	cl.Touch()
+	return cl.SendToClient([]byte{0})
+}
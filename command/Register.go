@@ -4,30 +4,59 @@ import (
 	"encoding/binary"
 	"errors"
 	"github.com/adrianleh/WTMP-middleend/client"
+	"github.com/adrianleh/WTMP-middleend/logging"
+	"github.com/google/uuid"
 )
 
 type RegisterCommandHandler struct{}
 
 func (RegisterCommandHandler) Handle(frame *CommandFrame) error {
+	return register(frame, false)
+}
+
+// register Registers the client, resumable clients additionally get their resume token appended to the response
+func register(frame *CommandFrame, resumable bool) error {
 	content, err := parseData(frame.Data)
 	if err != nil {
 		return err
 	}
 
-	cl, err := client.CreateClient(frame.ClientId, content.path, content.name)
+	cl, err := frame.Env.Clients.CreateClient(frame.ClientId, content.path, content.name)
 	if err != nil {
 		return err
 	}
+	cl.SetPeer(frame.Peer())
 	response := []byte{0}
-	err = client.Clients.Add(&cl)
+	err = frame.Env.Policy.AuthorizeRegister(peerUid(frame.Peer()), content.name)
+	if err == nil && resumable {
+		var token uuid.UUID
+		token, err = frame.Env.Clients.AddResumable(&cl)
+		if err == nil {
+			response = append(response, token[:]...)
+			frame.Conn.bind(cl.GetId())
+		}
+	} else if err == nil {
+		err = frame.Env.Clients.Add(&cl)
+	}
 	if err != nil {
+		notifyRejection(&cl, err)
 		response[0] = 1
+	} else {
+		logging.Infof("Registered client %s", cl.Describe())
 	}
 	errSend := cl.SendToClient(response)
-	if err == nil && errSend != nil {
-		return errSend
+	if err != nil {
+		cl.Close() // Not registered, nothing else will be sent
+		return err
+	}
+	return errSend
+}
+
+func peerUid(peer *client.Peer) *uint32 {
+	if peer == nil {
+		return nil
 	}
-	return err
+	return &peer.Uid
 }
 
 type registerCommandContent struct {
@@ -0,0 +1,91 @@
+package command
+
+import (
+	"fmt"
+	"sync"
+)
+
+// HandlerFunc adapts a function to the Handler interface
+type HandlerFunc func(frame *CommandFrame) error
+
+func (f HandlerFunc) Handle(frame *CommandFrame) error { return f(frame) }
+
+// Middleware wraps a handler, e.g. to log, authorize or measure every command
+type Middleware func(next Handler) Handler
+
+type Registry struct {
+	handlers   map[uint8]Handler
+	middleware []Middleware
+	mutex      *sync.RWMutex
+}
+
+func CreateRegistry() *Registry {
+	return &Registry{
+		handlers: map[uint8]Handler{},
+		mutex:    &sync.RWMutex{},
+	}
+}
+
+// DefaultRegistry Creates a registry serving the built-in commands, without any middleware
+func DefaultRegistry() *Registry {
+	reg := CreateRegistry()
+	reg.handlers[RegisterCommandId] = RegisterCommandHandler{}
+	reg.handlers[AcceptTypeCommandId] = AcceptTypeCommandHandler{}
+	reg.handlers[SendCommandId] = SendCommandHandler{}
+	reg.handlers[GetCommandId] = GetCommandHandler{}
+	reg.handlers[EmptyCommandId] = EmptyCommandHandler{}
+	reg.handlers[RegisterResumableCommandId] = RegisterResumableCommandHandler{}
+	reg.handlers[ResumeCommandId] = ResumeCommandHandler{}
+	reg.handlers[PingCommandId] = PingCommandHandler{}
+	reg.handlers[GetAnyCommandId] = GetAnyCommandHandler{}
+	reg.handlers[SendBatchCommandId] = SendBatchCommandHandler{}
+	reg.handlers[GetBatchCommandId] = GetBatchCommandHandler{}
+	reg.handlers[SendTransactionCommandId] = SendTransactionCommandHandler{}
+	return reg
+}
+
+// Register Serves commandId with handler, failing if the id is already taken
+func (reg *Registry) Register(commandId uint8, handler Handler) error {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	if reg.handlers[commandId] != nil {
+		return fmt.Errorf("command %d already has a handler", commandId)
+	}
+	reg.handlers[commandId] = handler
+	return nil
+}
+
+// Override Serves commandId with handler, replacing any existing handler
+func (reg *Registry) Override(commandId uint8, handler Handler) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	reg.handlers[commandId] = handler
+}
+
+func (reg *Registry) Unregister(commandId uint8) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	delete(reg.handlers, commandId)
+}
+
+// Use Appends middleware to the chain. Middleware added first sees a command first.
+func (reg *Registry) Use(middleware ...Middleware) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	reg.middleware = append(reg.middleware, middleware...)
+}
+
+// Lookup Returns the handler for commandId wrapped in the middleware chain.
+// Unknown commands are served by DefaultHandler so middleware sees them too.
+func (reg *Registry) Lookup(commandId uint8) Handler {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+	handler := reg.handlers[commandId]
+	if handler == nil {
+		handler = DefaultHandler{}
+	}
+	for i := len(reg.middleware) - 1; i >= 0; i-- {
+		handler = reg.middleware[i](handler)
+	}
+	return handler
+}
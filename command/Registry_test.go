@@ -0,0 +1,150 @@
+package command
+
+import (
+	"errors"
+	"github.com/adrianleh/WTMP-middleend/client"
+	"github.com/google/uuid"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRegisterAndLookup(t *testing.T) {
+	reg := CreateRegistry()
+	called := false
+	if err := reg.Register(42, HandlerFunc(func(*CommandFrame) error {
+		called = true
+		return nil
+	})); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := reg.Register(42, DefaultHandler{}); err == nil {
+		t.Error("Should not register the same id twice")
+	}
+	if err := reg.Lookup(42).Handle(&CommandFrame{CommandId: 42}); err != nil || !called {
+		t.Errorf("Handler not called (%v)", err)
+	}
+	if err := reg.Lookup(43).Handle(&CommandFrame{CommandId: 43}); err == nil {
+		t.Error("Unknown command should fail")
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	reg := CreateRegistry()
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(frame *CommandFrame) error {
+				order = append(order, name)
+				return next.Handle(frame)
+			})
+		}
+	}
+	reg.Use(trace("outer"), trace("inner"))
+	reg.Override(1, HandlerFunc(func(*CommandFrame) error {
+		order = append(order, "handler")
+		return nil
+	}))
+	_ = reg.Lookup(1).Handle(&CommandFrame{CommandId: 1})
+	if len(order) != 3 || order[0] != "outer" || order[1] != "inner" || order[2] != "handler" {
+		t.Errorf("Wrong order %v", order)
+	}
+}
+
+func TestRecoveryAndAuth(t *testing.T) {
+	reg := CreateRegistry()
+	denied := errors.New("denied")
+	reg.Use(RecoveryMiddleware, AuthMiddleware(func(frame *CommandFrame) error {
+		if frame.CommandId == 2 {
+			return denied
+		}
+		return nil
+	}))
+	reg.Override(1, HandlerFunc(func(*CommandFrame) error { panic("boom") }))
+	reg.Override(2, HandlerFunc(func(*CommandFrame) error { return nil }))
+	if err := reg.Lookup(1).Handle(&CommandFrame{CommandId: 1}); err == nil {
+		t.Error("Panic should turn into an error")
+	}
+	if err := reg.Lookup(2).Handle(&CommandFrame{CommandId: 2}); err != denied {
+		t.Errorf("Expected denial, got %v", err)
+	}
+}
+
+func TestPeerAuth(t *testing.T) {
+	cbPath := filepath.Join(t.TempDir(), "cb.sock")
+	callback, err := net.Listen("unix", cbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer callback.Close()
+	clients := client.CreateClientMap()
+	cl, err := client.CreateClient(uuid.New(), cbPath, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := &client.Peer{Uid: 1000, Gid: 1000, Pid: 42}
+	cl.SetPeer(owner)
+	if err := clients.Add(&cl); err != nil {
+		t.Fatal(err)
+	}
+
+	env := &Env{Clients: &clients, Registry: CreateRegistry()}
+	env.Registry.Use(PeerAuthMiddleware)
+	env.Registry.Override(GetCommandId, HandlerFunc(func(*CommandFrame) error { return nil }))
+	handler := env.Registry.Lookup(GetCommandId)
+
+	ownFrame := &CommandFrame{ClientId: cl.GetId(), CommandId: GetCommandId, Env: env, Conn: &Conn{Peer: &client.Peer{Uid: 1000, Gid: 1000, Pid: 42}}}
+	if err := handler.Handle(ownFrame); err != nil {
+		t.Errorf("Owner should pass, got %v", err)
+	}
+	foreignFrame := &CommandFrame{ClientId: cl.GetId(), CommandId: GetCommandId, Env: env, Conn: &Conn{Peer: &client.Peer{Uid: 1000, Gid: 1000, Pid: 43}}}
+	if err := handler.Handle(foreignFrame); err == nil {
+		t.Error("Other process should be rejected")
+	}
+	unknownFrame := &CommandFrame{ClientId: cl.GetId(), CommandId: GetCommandId, Env: env, Conn: &Conn{}}
+	if err := handler.Handle(unknownFrame); err == nil {
+		t.Error("Unknown process should be rejected")
+	}
+}
+
+func TestSubmitAuthenticatesBeforeLocking(t *testing.T) {
+	cbPath := filepath.Join(t.TempDir(), "cb.sock")
+	callback, err := net.Listen("unix", cbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer callback.Close()
+	clients := client.CreateClientMap()
+	cl, err := client.CreateClient(uuid.New(), cbPath, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl.SetPeer(&client.Peer{Uid: 1000, Gid: 1000, Pid: 42})
+	if err := clients.Add(&cl); err != nil {
+		t.Fatal(err)
+	}
+	env := &Env{Clients: &clients, Registry: CreateRegistry(), AuthenticatePeers: true}
+	env.Registry.Override(PingCommandId, HandlerFunc(func(*CommandFrame) error { return nil }))
+
+	mutex := cl.GetCommandMutex()
+	mutex.Lock() // A command of alice is in progress
+	defer mutex.Unlock()
+	rawFrame := make([]byte, 25)
+	id := cl.GetId()
+	copy(rawFrame, id[:])
+	rawFrame[16] = PingCommandId
+	done := make(chan error, 1)
+	go func() {
+		done <- env.Submit(&Conn{Peer: &client.Peer{Uid: 1000, Gid: 1000, Pid: 43}}, rawFrame)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Other process should be rejected")
+		}
+	case <-time.After(time.Second):
+		t.Error("Other process should be rejected without waiting for the client's command mutex")
+	}
+}
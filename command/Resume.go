@@ -0,0 +1,65 @@
+package command
+
+import (
+	"errors"
+	"github.com/adrianleh/WTMP-middleend/client"
+	"github.com/adrianleh/WTMP-middleend/logging"
+	"github.com/google/uuid"
+	"net"
+)
+
+type RegisterResumableCommandHandler struct{}
+
+func (RegisterResumableCommandHandler) Handle(frame *CommandFrame) error {
+	return register(frame, true)
+}
+
+// ResumeCommandHandler Lets a restarted client reclaim a session by sending its resume token followed by the path of
+// its new callback socket. The frame's client id becomes the session's id from then on.
+type ResumeCommandHandler struct{}
+
+func (ResumeCommandHandler) Handle(frame *CommandFrame) error {
+	if len(frame.Data) <= 16 {
+		return errors.New("data must hold a resume token and a path")
+	}
+	token, err := uuid.FromBytes(frame.Data[0:16])
+	if err != nil {
+		return err
+	}
+	path := string(frame.Data[16:])
+	sock, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+
+	err = resume(frame, token, path, sock)
+	if err != nil {
+		_, _ = sock.Write(client.EncodeReply([]byte{1}))
+		sock.Close()
+		return err
+	}
+	return nil
+}
+
+func resume(frame *CommandFrame, token uuid.UUID, path string, sock net.Conn) error {
+	cl := frame.Env.Clients.SessionClient(token)
+	if cl == nil {
+		return errors.New("unknown resume token")
+	}
+	// Submit only locked the client being resumed if the frame carries its old id
+	if cl.GetId() != frame.ClientId {
+		mutex := cl.GetCommandMutex()
+		mutex.Lock()
+		defer mutex.Unlock()
+	}
+	if err := frame.Env.Policy.AuthorizeRegister(peerUid(frame.Peer()), cl.GetName()); err != nil {
+		return err
+	}
+	cl, err := frame.Env.Clients.Resume(token, frame.ClientId, path, sock, frame.Peer())
+	if err != nil {
+		return err
+	}
+	frame.Conn.bind(cl.GetId())
+	logging.Infof("Resumed client %s", cl.Describe())
+	return cl.SendToClient([]byte{0})
+}
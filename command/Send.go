@@ -4,31 +4,118 @@ import (
 	"encoding/binary"
 	"errors"
 	"github.com/adrianleh/WTMP-middleend/client"
+	"github.com/adrianleh/WTMP-middleend/policy"
+	"github.com/adrianleh/WTMP-middleend/quota"
 	"github.com/adrianleh/WTMP-middleend/types"
 )
 
 type SendCommandHandler struct{}
 
 func (SendCommandHandler) Handle(frame *CommandFrame) error {
-	content, err := sendData(frame.Data)
+	content, err := sendData(frame.Env.Clients, frame.Data)
 	if err != nil {
 		return err
 	}
+	return send(frame, frame.Env.Clients.GetById(frame.ClientId), content)
+}
+
+// send Authorizes, rate limits and pushes a message of sender, which is nil for unregistered senders, notifying the
+// sender if it is denied or over quota
+func send(frame *CommandFrame, sender *client.Client, content sendCommandContent) error {
+	err := deliver(frame, sender, content)
+	if sender != nil {
+		notifyRejection(sender, err)
+	}
+	return err
+}
 
-	cl := client.Clients.GetByName(content.target)
+// deliver Is send without notifications, for commands that report the result of each message in their response
+func deliver(frame *CommandFrame, sender *client.Client, content sendCommandContent) error {
+	if err := admitSend(frame, sender, content); err != nil {
+		return err
+	}
+	cl := frame.Env.Clients.GetByName(content.target)
 	if cl == nil {
 		return errors.New("client not found")
 	}
 	return cl.Push(content.typ, content.msg)
 }
 
+// notifyRejection Notifies cl if err denied its command or was a quota it exceeded
+func notifyRejection(cl *client.Client, err error) {
+	var denied *policy.DeniedError
+	var exceeded *quota.ExceededError
+	switch {
+	case errors.As(err, &denied):
+		_ = cl.Notify(client.DeniedNotification, []byte(err.Error()))
+	case errors.As(err, &exceeded):
+		_ = cl.Notify(client.QuotaNotification, []byte(err.Error()))
+	}
+}
+
+// admitSend Authorizes, validates and rate limits a message
+func admitSend(frame *CommandFrame, sender *client.Client, content sendCommandContent) error {
+	if err := authorizeSend(frame, sender, content); err != nil {
+		return err
+	}
+	return allowSend(frame, sender, uint64(len(content.msg)))
+}
+
+// authorizeSend Authorizes and validates a message
+func authorizeSend(frame *CommandFrame, sender *client.Client, content sendCommandContent) error {
+	senderName := ""
+	if sender != nil {
+		senderName = sender.GetName()
+	}
+	if err := frame.Env.Policy.AuthorizeSend(senderName, content.target, content.typ); err != nil {
+		return err
+	}
+	if frame.Env.ValidatePayloads {
+		if err := types.Validate(content.typ, content.msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allowSend Charges a message against the sender's rate limits, unregistered senders are limited per connection
+func allowSend(frame *CommandFrame, sender *client.Client, size uint64) error {
+	if sender != nil {
+		return sender.AllowSend(size)
+	}
+	if frame.Conn != nil {
+		return frame.Conn.SendLimiter.Allow(size)
+	}
+	return nil
+}
+
+// checkSends Checks messages of sizes against the sender's rate limits like allowSend, without charging them
+func checkSends(frame *CommandFrame, sender *client.Client, sizes []uint64) error {
+	if sender != nil {
+		return sender.CheckSend(sizes...)
+	}
+	if frame.Conn != nil {
+		return frame.Conn.SendLimiter.Check(sizes...)
+	}
+	return nil
+}
+
+// chargeSends Charges messages of sizes that checkSends allowed once they were sent
+func chargeSends(frame *CommandFrame, sender *client.Client, sizes []uint64) {
+	if sender != nil {
+		sender.ChargeSend(sizes...)
+	} else if frame.Conn != nil {
+		frame.Conn.SendLimiter.Take(sizes...)
+	}
+}
+
 type sendCommandContent struct {
 	typ    types.Type
 	target string
 	msg    []byte
 }
 
-func sendData(data []byte) (sendCommandContent, error) {
+func sendData(clients *client.ClientMap, data []byte) (sendCommandContent, error) {
 	if len(data) < 8 {
 		return sendCommandContent{}, errors.New("data must at least have delimiters")
 	}
@@ -49,7 +136,7 @@ func sendData(data []byte) (sendCommandContent, error) {
 
 	name := string(nameRaw)
 
-	typ, err := types.Deserialize(typeRaw)
+	typ, err := clients.DeserializeType(typeRaw)
 	if err != nil {
 		return sendCommandContent{}, err
 	}
@@ -0,0 +1,87 @@
+package command
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/adrianleh/WTMP-middleend/client"
+)
+
+// SendTransactionCommandHandler Sends several messages all-or-nothing. Data is laid out like that of a SendBatch.
+// Every item is checked before any is pushed: it must be authorized, its target must accept its type and all items
+// together must be within the sender's rate limits, which are only charged if the transaction commits. The pushes
+// are then applied atomically. A registered sender receives the number of items (4) followed by one result byte per
+// item, valid items of a failed transaction being BatchItemAborted. Like for a SendBatch, failures are not notified
+// besides.
+type SendTransactionCommandHandler struct{}
+
+func (SendTransactionCommandHandler) Handle(frame *CommandFrame) error {
+	items, err := batchItems(frame.Data)
+	if err != nil {
+		return err
+	}
+
+	sender := frame.Env.Clients.GetById(frame.ClientId)
+	results := make([]byte, len(items))
+	deliveries := make([]client.Delivery, 0, len(items))
+	sizes := make([]uint64, 0, len(items))
+	var txErr error
+	for i, item := range items {
+		delivery, size, err := prepareSend(frame, sender, item)
+		if err != nil {
+			results[i] = batchItemResult(err)
+			if txErr == nil {
+				txErr = err
+			}
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+		sizes = append(sizes, size)
+	}
+
+	if txErr == nil {
+		// The rate limits are charged only once the transaction went through
+		if txErr = checkSends(frame, sender, sizes); txErr == nil {
+			txErr = client.Deliver(deliveries)
+		}
+		if txErr == nil {
+			chargeSends(frame, sender, sizes)
+		} else {
+			for i := range results {
+				results[i] = batchItemResult(txErr)
+			}
+		}
+	} else {
+		for i, result := range results {
+			if result == BatchItemSent {
+				results[i] = BatchItemAborted
+			}
+		}
+	}
+
+	if sender != nil {
+		response := make([]byte, 4, 4+len(results))
+		binary.BigEndian.PutUint32(response, uint32(len(results)))
+		if err := sender.SendToClient(append(response, results...)); err != nil && txErr == nil {
+			return err
+		}
+	}
+	return txErr
+}
+
+// prepareSend Prepares the delivery of an item, returning the size its message is charged against the rate limits
+// with
+func prepareSend(frame *CommandFrame, sender *client.Client, item []byte) (client.Delivery, uint64, error) {
+	content, err := sendData(frame.Env.Clients, item)
+	if err != nil {
+		return client.Delivery{}, 0, err
+	}
+	if err := authorizeSend(frame, sender, content); err != nil {
+		return client.Delivery{}, 0, err
+	}
+	cl := frame.Env.Clients.GetByName(content.target)
+	if cl == nil {
+		return client.Delivery{}, 0, errors.New("client not found")
+	}
+	delivery, err := cl.Prepare(content.typ, content.msg)
+	return delivery, uint64(len(content.msg)), err
+}
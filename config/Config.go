@@ -0,0 +1,369 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/adrianleh/WTMP-middleend/logging"
+	"github.com/adrianleh/WTMP-middleend/presence"
+	"github.com/adrianleh/WTMP-middleend/quota"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultSocketPath = "/tmp/wtmp.sock"
+
+// EnvPrefix is prepended to the upper-cased config key to form the name of the overriding environment variable,
+// e.g. WTMP_SOCKET_PATH overrides socket_path
+const EnvPrefix = "WTMP_"
+
+type Config struct {
+	SocketPaths    []string
+	SocketMode     os.FileMode
+	SocketOwner    string
+	SocketGroup    string
+	MaxQueueLength uint64 // 0 means unbounded
+	MaxMessageSize uint64 // 0 means unbounded
+	Limits         quota.Limits
+	PersistenceDir string
+	LogLevel       string
+	MetricsAddr    string
+	SessionExpiry  time.Duration
+	// HeartbeatInterval between broker pings, 0 disables liveness detection
+	HeartbeatInterval time.Duration
+	HeartbeatMissed   uint
+	DeadClientPolicy  string
+	PolicyFile        string
+	AuditLog          string
+	// ShutdownTimeout bounds how long a graceful shutdown may take before the broker exits anyway
+	ShutdownTimeout time.Duration
+	// OutboundQueueLength messages may wait for a client's callback socket, WriteTimeout bounds a single write
+	OutboundQueueLength int
+	WriteTimeout        time.Duration
+	ValidatePayloads    bool
+}
+
+func Default() Config {
+	return Config{
+		SocketPaths:      []string{DefaultSocketPath},
+		SocketMode:       0660,
+		LogLevel:         "info",
+		SessionExpiry:    5 * time.Minute,
+		HeartbeatMissed:  3,
+		DeadClientPolicy: "none",
+		ShutdownTimeout:  10 * time.Second,
+
+		OutboundQueueLength: 1024,
+		WriteTimeout:        5 * time.Second,
+	}
+}
+
+// Keys Lists all keys understood by Set, in the order they are documented
+var Keys = []string{
+	"socket_path",
+	"socket_mode",
+	"socket_owner",
+	"socket_group",
+	"max_queue_length",
+	"max_message_size",
+	"rate_messages_per_second",
+	"rate_bytes_per_second",
+	"rate_message_burst",
+	"rate_byte_burst",
+	"max_accepted_types",
+	"max_queued_bytes",
+	"max_clients",
+	"persistence_dir",
+	"log_level",
+	"metrics_addr",
+	"shutdown_timeout",
+	"session_expiry",
+	"heartbeat_interval",
+	"heartbeat_missed",
+	"dead_client_policy",
+	"policy_file",
+	"audit_log",
+	"outbound_queue_length",
+	"write_timeout",
+	"validate_payloads",
+}
+
+// Set Assigns a single config value given in its textual form.
+// socket_path may be given a comma separated list and replaces any previously configured paths,
+// paths starting with '@' name linux abstract-namespace sockets.
+func (cfg *Config) Set(key string, value string) error {
+	value = strings.TrimSpace(value)
+	switch key {
+	case "socket_path":
+		var paths []string
+		for _, path := range strings.Split(value, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				paths = append(paths, path)
+			}
+		}
+		cfg.SocketPaths = paths
+	case "socket_mode":
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil {
+			return fmt.Errorf("socket_mode: %v", err)
+		}
+		cfg.SocketMode = os.FileMode(mode)
+	case "socket_owner":
+		cfg.SocketOwner = value
+	case "socket_group":
+		cfg.SocketGroup = value
+	case "max_queue_length":
+		limit, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("max_queue_length: %v", err)
+		}
+		cfg.MaxQueueLength = limit
+	case "max_message_size":
+		limit, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("max_message_size: %v", err)
+		}
+		cfg.MaxMessageSize = limit
+	case "rate_messages_per_second", "rate_bytes_per_second", "rate_message_burst", "rate_byte_burst":
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		switch key {
+		case "rate_messages_per_second":
+			cfg.Limits.MessagesPerSecond = rate
+		case "rate_bytes_per_second":
+			cfg.Limits.BytesPerSecond = rate
+		case "rate_message_burst":
+			cfg.Limits.MessageBurst = rate
+		default:
+			cfg.Limits.ByteBurst = rate
+		}
+	case "max_accepted_types", "max_queued_bytes", "max_clients":
+		limit, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		switch key {
+		case "max_accepted_types":
+			cfg.Limits.MaxAcceptedTypes = limit
+		case "max_queued_bytes":
+			cfg.Limits.MaxQueuedBytes = limit
+		default:
+			cfg.Limits.MaxClients = limit
+		}
+	case "persistence_dir":
+		cfg.PersistenceDir = value
+	case "log_level":
+		cfg.LogLevel = strings.ToLower(value)
+	case "metrics_addr":
+		cfg.MetricsAddr = value
+	case "policy_file":
+		cfg.PolicyFile = value
+	case "audit_log":
+		cfg.AuditLog = value
+	case "heartbeat_missed":
+		missed, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("heartbeat_missed: %v", err)
+		}
+		cfg.HeartbeatMissed = uint(missed)
+	case "dead_client_policy":
+		cfg.DeadClientPolicy = value
+	case "validate_payloads":
+		validate, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("validate_payloads: %v", err)
+		}
+		cfg.ValidatePayloads = validate
+	case "outbound_queue_length":
+		length, err := strconv.ParseUint(value, 10, 31)
+		if err != nil {
+			return fmt.Errorf("outbound_queue_length: %v", err)
+		}
+		cfg.OutboundQueueLength = int(length)
+	case "shutdown_timeout", "session_expiry", "heartbeat_interval", "write_timeout":
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		switch key {
+		case "shutdown_timeout":
+			cfg.ShutdownTimeout = duration
+		case "session_expiry":
+			cfg.SessionExpiry = duration
+		case "write_timeout":
+			cfg.WriteTimeout = duration
+		default:
+			cfg.HeartbeatInterval = duration
+		}
+	default:
+		return fmt.Errorf("unknown config key \"%s\"", key)
+	}
+	return nil
+}
+
+// Load Reads the config file at path on top of the defaults.
+// Files starting with '{' are parsed as JSON, everything else as key=value lines.
+func Load(path string) (Config, error) {
+	cfg := Default()
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+		err = cfg.parseJSON(raw)
+	} else {
+		err = cfg.parseKeyValue(raw)
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) parseKeyValue(raw []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sepIdx := strings.Index(line, "=")
+		if sepIdx < 0 {
+			return fmt.Errorf("line %d: expected key=value", lineNo)
+		}
+		key := strings.TrimSpace(line[:sepIdx])
+		if err := cfg.Set(key, line[sepIdx+1:]); err != nil {
+			return fmt.Errorf("line %d: %v", lineNo, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (cfg *Config) parseJSON(raw []byte) error {
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return err
+	}
+	for key, rawValue := range entries {
+		value, err := jsonValueToString(rawValue)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		if err := cfg.Set(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonValueToString Converts strings, numbers, booleans and lists of strings to the textual form accepted by Set
+func jsonValueToString(raw json.RawMessage) (string, error) {
+	var str string
+	if err := json.Unmarshal(raw, &str); err == nil {
+		return str, nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return strings.Join(list, ","), nil
+	}
+	var num json.Number
+	if err := json.Unmarshal(raw, &num); err == nil {
+		return num.String(), nil
+	}
+	var boolean bool
+	if err := json.Unmarshal(raw, &boolean); err == nil {
+		return strconv.FormatBool(boolean), nil
+	}
+	return "", errors.New("unsupported value")
+}
+
+// ApplyEnv Overrides every key for which lookup finds a variable named EnvPrefix + upper-cased key
+func (cfg *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	for _, key := range Keys {
+		name := EnvPrefix + strings.ToUpper(key)
+		if value, ok := lookup(name); ok {
+			if err := cfg.Set(key, value); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (cfg Config) Validate() error {
+	if len(cfg.SocketPaths) == 0 {
+		return errors.New("at least one socket path is required")
+	}
+	seen := map[string]bool{}
+	for _, path := range cfg.SocketPaths {
+		if seen[path] {
+			return fmt.Errorf("socket path \"%s\" configured twice", path)
+		}
+		seen[path] = true
+	}
+	if cfg.SocketMode&^os.ModePerm != 0 {
+		return fmt.Errorf("socket_mode %o has bits outside of permission bits", cfg.SocketMode)
+	}
+	if _, err := logging.ParseLevel(cfg.LogLevel); err != nil {
+		return err
+	}
+	if cfg.PersistenceDir != "" {
+		info, err := os.Stat(cfg.PersistenceDir)
+		if err != nil {
+			return fmt.Errorf("persistence_dir: %v", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("persistence_dir \"%s\" is not a directory", cfg.PersistenceDir)
+		}
+	}
+	if cfg.Limits.MessagesPerSecond < 0 || cfg.Limits.BytesPerSecond < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	if cfg.Limits.MessageBurst < 0 || cfg.Limits.ByteBurst < 0 {
+		return errors.New("rate bursts must not be negative")
+	}
+	if cfg.Limits.MessagesPerSecond > 0 && cfg.Limits.MessageCapacity() < 1 {
+		return errors.New("rate_message_burst must be at least 1 so messages can be sent at all")
+	}
+	if cfg.Limits.BytesPerSecond > 0 && cfg.Limits.ByteCapacity() < float64(cfg.MaxMessageSize) {
+		return fmt.Errorf("rate_byte_burst of %g bytes is below max_message_size, larger messages could never be sent",
+			cfg.Limits.ByteCapacity())
+	}
+	if cfg.SessionExpiry < 0 {
+		return errors.New("session_expiry must not be negative")
+	}
+	if cfg.HeartbeatInterval < 0 {
+		return errors.New("heartbeat_interval must not be negative")
+	}
+	if cfg.HeartbeatMissed == 0 {
+		return errors.New("heartbeat_missed must be at least 1")
+	}
+	if _, err := presence.ParseDeadClientPolicy(cfg.DeadClientPolicy); err != nil {
+		return fmt.Errorf("dead_client_policy: %v", err)
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		return errors.New("shutdown_timeout must be positive")
+	}
+	if cfg.OutboundQueueLength < 1 {
+		return errors.New("outbound_queue_length must be at least 1")
+	}
+	if cfg.WriteTimeout <= 0 {
+		return errors.New("write_timeout must be positive")
+	}
+	if cfg.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.MetricsAddr); err != nil {
+			return fmt.Errorf("metrics_addr: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTemp(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "wtmpd.conf")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadKeyValue(t *testing.T) {
+	path := writeTemp(t, "# comment\nsocket_path = /tmp/a.sock, /tmp/b.sock\nsocket_mode=0600\nmax_queue_length=10\nlog_level=DEBUG\n")
+	cfg, err := Load(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(cfg.SocketPaths) != 2 || cfg.SocketPaths[1] != "/tmp/b.sock" {
+		t.Errorf("Wrong socket paths %v", cfg.SocketPaths)
+	}
+	if cfg.SocketMode != 0600 {
+		t.Errorf("Wrong mode %o", cfg.SocketMode)
+	}
+	if cfg.MaxQueueLength != 10 {
+		t.Errorf("Wrong queue length %d", cfg.MaxQueueLength)
+	}
+	if cfg.LogLevel != "debug" {
+		t.Errorf("Wrong log level %s", cfg.LogLevel)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadJSON(t *testing.T) {
+	path := writeTemp(t, `{"socket_path": ["/tmp/a.sock"], "max_message_size": 4096, "metrics_addr": "127.0.0.1:9100"}`)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(cfg.SocketPaths) != 1 || cfg.SocketPaths[0] != "/tmp/a.sock" {
+		t.Errorf("Wrong socket paths %v", cfg.SocketPaths)
+	}
+	if cfg.MaxMessageSize != 4096 {
+		t.Errorf("Wrong message size %d", cfg.MaxMessageSize)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnknownKey(t *testing.T) {
+	path := writeTemp(t, "no_such_key=1\n")
+	if _, err := Load(path); err == nil {
+		t.Error("Should reject unknown key")
+	}
+}
+
+func TestEnvOverride(t *testing.T) {
+	cfg := Default()
+	env := map[string]string{"WTMP_LOG_LEVEL": "warn", "WTMP_SOCKET_PATH": "@wtmp"}
+	err := cfg.ApplyEnv(func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if cfg.LogLevel != "warn" || cfg.SocketPaths[0] != "@wtmp" {
+		t.Errorf("Env not applied: %+v", cfg)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.LogLevel = "verbose"
+	if cfg.Validate() == nil {
+		t.Error("Should reject log level")
+	}
+	cfg = Default()
+	cfg.PersistenceDir = filepath.Join(os.TempDir(), "does-not-exist-wtmp")
+	if cfg.Validate() == nil {
+		t.Error("Should reject missing persistence dir")
+	}
+	cfg = Default()
+	cfg.SocketPaths = []string{"/tmp/a.sock", "/tmp/a.sock"}
+	if cfg.Validate() == nil {
+		t.Error("Should reject duplicate sockets")
+	}
+	cfg = Default()
+	cfg.DeadClientPolicy = "forget"
+	if cfg.Validate() == nil {
+		t.Error("Should reject unknown dead client policy")
+	}
+	cfg = Default()
+	cfg.MaxMessageSize = 4096
+	cfg.Limits.BytesPerSecond = 1024
+	if cfg.Validate() == nil {
+		t.Error("Should reject a byte burst smaller than the largest message")
+	}
+	cfg.Limits.ByteBurst = 4096
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Burst covering the largest message should be valid, got %v", err)
+	}
+	cfg.Limits.MessagesPerSecond = 0.5
+	cfg.Limits.MessageBurst = 0.5
+	if cfg.Validate() == nil {
+		t.Error("Should reject a message burst below one message")
+	}
+}
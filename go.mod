@@ -1,5 +1,5 @@
 module github.com/adrianleh/WTMP-middleend
 
-go 1.16
+go 1.18
 
 require github.com/google/uuid v1.2.0
@@ -0,0 +1,47 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+type Level int32
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var currentLevel = int32(InfoLevel)
+
+func ParseLevel(name string) (Level, error) {
+	switch name {
+	case "debug":
+		return DebugLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "warn":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	}
+	return InfoLevel, fmt.Errorf("unknown log level \"%s\"", name)
+}
+
+func SetLevel(level Level) { atomic.StoreInt32(&currentLevel, int32(level)) }
+
+func Enabled(level Level) bool { return int32(level) >= atomic.LoadInt32(&currentLevel) }
+
+func logf(level Level, prefix string, format string, args ...interface{}) {
+	if Enabled(level) {
+		log.Printf(prefix+format, args...)
+	}
+}
+
+func Debugf(format string, args ...interface{}) { logf(DebugLevel, "DEBUG ", format, args...) }
+func Infof(format string, args ...interface{})  { logf(InfoLevel, "INFO ", format, args...) }
+func Warnf(format string, args ...interface{})  { logf(WarnLevel, "WARN ", format, args...) }
+func Errorf(format string, args ...interface{}) { logf(ErrorLevel, "ERROR ", format, args...) }
@@ -6,30 +6,75 @@ import (
 )
 
 type MessageQueue struct {
-	elemSize uint64
-	data     [][]byte
-	lock     *sync.Mutex
+	elemSize  uint64
+	variable  bool // Elements of any size are accepted, elemSize is ignored
+	maxLength uint64
+	data      []entry
+	lock      *sync.Mutex
+}
+
+// entry is a queued element with the sequence number it was pushed with
+type entry struct {
+	seq  uint64
+	data []byte
 }
 
 func CreateMessageQueue(elemSize uint64) MessageQueue {
+	return CreateBoundedMessageQueue(elemSize, 0)
+}
+
+// CreateBoundedMessageQueue Creates a queue holding at most maxLength elements, 0 meaning unbounded
+func CreateBoundedMessageQueue(elemSize uint64, maxLength uint64) MessageQueue {
 	return MessageQueue{
-		elemSize: elemSize,
-		data:     make([][]byte, 0),
-		lock:     &sync.Mutex{},
+		elemSize:  elemSize,
+		maxLength: maxLength,
+		data:      make([]entry, 0),
+		lock:      &sync.Mutex{},
 	}
 }
 
+// CreateVariableMessageQueue Creates a queue for elements of varying sizes holding at most maxLength elements,
+// 0 meaning unbounded
+func CreateVariableMessageQueue(maxLength uint64) MessageQueue {
+	mq := CreateBoundedMessageQueue(0, maxLength)
+	mq.variable = true
+	return mq
+}
+
 func (mq *MessageQueue) Empty() bool {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
 	return len(mq.data) == 0
 }
 
+func (mq *MessageQueue) Len() int {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	return len(mq.data)
+}
+
+// Fits Tells whether n more elements can be pushed before the queue is full
+func (mq *MessageQueue) Fits(n uint64) bool {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	return mq.maxLength == 0 || uint64(len(mq.data))+n <= mq.maxLength
+}
+
 func (mq *MessageQueue) Push(el []byte) error {
-	if uint64(len(el)) != mq.elemSize {
+	return mq.PushSequenced(el, 0)
+}
+
+// PushSequenced Pushes el tagged with seq, which lets callers order elements across several queues
+func (mq *MessageQueue) PushSequenced(el []byte, seq uint64) error {
+	if !mq.variable && uint64(len(el)) != mq.elemSize {
 		return errors.New("size mismatch")
 	}
 	mq.lock.Lock()
 	defer mq.lock.Unlock()
-	mq.data = append(mq.data, el)
+	if mq.maxLength != 0 && uint64(len(mq.data)) >= mq.maxLength {
+		return errors.New("queue full")
+	}
+	mq.data = append(mq.data, entry{seq: seq, data: el})
 	return nil
 }
 
@@ -39,7 +84,17 @@ func (mq *MessageQueue) Peek() ([]byte, error) {
 	if len(mq.data) == 0 {
 		return nil, errors.New("queue empty")
 	}
-	return mq.data[0], nil
+	return mq.data[0].data, nil
+}
+
+// PeekSequence Returns the sequence number the oldest element was pushed with
+func (mq *MessageQueue) PeekSequence() (uint64, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	if len(mq.data) == 0 {
+		return 0, errors.New("queue empty")
+	}
+	return mq.data[0].seq, nil
 }
 
 func (mq *MessageQueue) Pop() ([]byte, error) {
@@ -50,5 +105,16 @@ func (mq *MessageQueue) Pop() ([]byte, error) {
 	}
 	top := mq.data[0]
 	mq.data = mq.data[1:]
-	return top, nil
+	return top.data, nil
+}
+
+// Snapshot Returns a copy of the queued elements, oldest first
+func (mq *MessageQueue) Snapshot() [][]byte {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	snapshot := make([][]byte, len(mq.data))
+	for i, el := range mq.data {
+		snapshot[i] = el.data
+	}
+	return snapshot
 }
@@ -62,3 +62,42 @@ func TestPar(t *testing.T) {
 		t.Errorf("Didn't pop enough items")
 	}
 }
+
+func TestBounded(t *testing.T) {
+	mq := CreateBoundedMessageQueue(1, 2)
+	b := []byte{1}
+	for i := 0; i < 2; i++ {
+		if err := mq.Push(b); err != nil {
+			t.Errorf("Failed to push, %v", err)
+			return
+		}
+	}
+	if err := mq.Push(b); err == nil {
+		t.Errorf("Should not push into full queue")
+		return
+	}
+	if _, err := mq.Pop(); err != nil {
+		t.Errorf("Failed to pop, %v", err)
+		return
+	}
+	if err := mq.Push(b); err != nil {
+		t.Errorf("Failed to push after pop, %v", err)
+		return
+	}
+}
+
+func TestVariable(t *testing.T) {
+	mq := CreateVariableMessageQueue(0)
+	for _, el := range [][]byte{{1}, {1, 2, 3}, {}} {
+		if err := mq.Push(el); err != nil {
+			t.Errorf("Failed to push, %v", err)
+			return
+		}
+	}
+	if el, _ := mq.Pop(); len(el) != 1 {
+		t.Errorf("Popped %v", el)
+	}
+	if el, _ := mq.Pop(); len(el) != 3 {
+		t.Errorf("Popped %v", el)
+	}
+}
@@ -0,0 +1,282 @@
+package policy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/adrianleh/WTMP-middleend/types"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"strings"
+)
+
+// fingerprintPrefix Starts a type pattern matching the type with the hex encoded fingerprint that follows
+const fingerprintPrefix = "fingerprint:"
+
+// Rules is the JSON representation of a policy.
+// Every action with at least one rule is only allowed if one of its rules matches, actions without rules fall back
+// to Default. Patterns use path.Match syntax and match client names and type names, an empty list matches anything.
+// Type names are not unique, e.g. "Union-Struct-Int32-Int64" names a union of a struct and Int64 as well as a union
+// of a single struct, so a type pattern of the form "fingerprint:<hex>" matches the one type with that fingerprint
+// instead. Unregistered senders have no name and only match send rules without sender patterns.
+type Rules struct {
+	Default    string         `json:"default"` // "allow" (the default) or "deny"
+	Register   []RegisterRule `json:"register"`
+	AcceptType []TypeRule     `json:"accept_type"`
+	Send       []SendRule     `json:"send"`
+	Get        []TypeRule     `json:"get"`
+}
+
+// RegisterRule Allows processes running as one of Uids to register under one of Names
+type RegisterRule struct {
+	Uids  []uint32 `json:"uids"`
+	Names []string `json:"names"`
+}
+
+// TypeRule Allows clients matching Clients to use types matching Types
+type TypeRule struct {
+	Clients []string `json:"clients"`
+	Types   []string `json:"types"`
+}
+
+// SendRule Allows senders matching Senders to send types matching Types to targets matching Targets
+type SendRule struct {
+	Senders []string `json:"senders"`
+	Targets []string `json:"targets"`
+	Types   []string `json:"types"`
+}
+
+type DeniedError struct {
+	Action string
+	Detail string
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("%s denied: %s", e.Action, e.Detail)
+}
+
+// Policy authorizes commands and audits denials. A nil Policy allows everything.
+type Policy struct {
+	rules        Rules
+	defaultAllow bool
+	audit        *log.Logger
+}
+
+func Parse(raw []byte) (*Policy, error) {
+	var rules Rules
+	if err := json.Unmarshal(raw, &rules); err != nil {
+		return nil, err
+	}
+	return Create(rules)
+}
+
+func Load(path string) (*Policy, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return p, nil
+}
+
+func Create(rules Rules) (*Policy, error) {
+	p := &Policy{rules: rules}
+	switch rules.Default {
+	case "", "allow":
+		p.defaultAllow = true
+	case "deny":
+		p.defaultAllow = false
+	default:
+		return nil, fmt.Errorf("default must be \"allow\" or \"deny\", got \"%s\"", rules.Default)
+	}
+	var patterns []string
+	for _, rule := range rules.Register {
+		patterns = append(patterns, rule.Names...)
+	}
+	for _, rule := range append(append([]TypeRule{}, rules.AcceptType...), rules.Get...) {
+		patterns = append(append(patterns, rule.Clients...), rule.Types...)
+	}
+	for _, rule := range rules.Send {
+		patterns = append(append(append(patterns, rule.Senders...), rule.Targets...), rule.Types...)
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern \"%s\": %v", pattern, err)
+		}
+	}
+	for _, pattern := range typePatterns(rules) {
+		fp := strings.TrimPrefix(pattern, fingerprintPrefix)
+		if fp == pattern {
+			continue
+		}
+		if raw, err := hex.DecodeString(fp); err != nil || len(raw) != len(types.Fingerprint{}) {
+			return nil, fmt.Errorf("invalid pattern \"%s\": not a hex encoded fingerprint", pattern)
+		}
+	}
+	return p, nil
+}
+
+func typePatterns(rules Rules) []string {
+	var patterns []string
+	for _, rule := range append(append([]TypeRule{}, rules.AcceptType...), rules.Get...) {
+		patterns = append(patterns, rule.Types...)
+	}
+	for _, rule := range rules.Send {
+		patterns = append(patterns, rule.Types...)
+	}
+	return patterns
+}
+
+// SetAuditLog Writes a line for every denial to w, by default denials go to the standard logger
+func (p *Policy) SetAuditLog(w io.Writer) {
+	p.audit = log.New(w, "", log.LstdFlags)
+}
+
+func (p *Policy) deny(action string, format string, args ...interface{}) error {
+	err := &DeniedError{Action: action, Detail: fmt.Sprintf(format, args...)}
+	if p.audit != nil {
+		p.audit.Printf("audit: %v", err)
+	} else {
+		log.Printf("audit: %v", err)
+	}
+	return err
+}
+
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched { // Patterns are validated in Create
+			return true
+		}
+	}
+	return false
+}
+
+// matchesType Is matchesAny for the name of typ, fingerprint patterns matching its fingerprint instead
+func matchesType(patterns []string, typ types.Type) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	name, fp := typ.Name(), ""
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, fingerprintPrefix) {
+			if fp == "" {
+				fp = types.FingerprintOf(typ).String()
+			}
+			if strings.EqualFold(pattern[len(fingerprintPrefix):], fp) {
+				return true
+			}
+		} else if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesSender Is matchesAny for sender names, an unregistered sender only matching the empty list
+func matchesSender(patterns []string, sender string) bool {
+	if sender == "" {
+		return len(patterns) == 0
+	}
+	return matchesAny(patterns, sender)
+}
+
+// AuthorizeRegister Checks whether the process running as uid may register as name, nil uid meaning unknown
+func (p *Policy) AuthorizeRegister(uid *uint32, name string) error {
+	if p == nil {
+		return nil
+	}
+	if len(p.rules.Register) == 0 {
+		if p.defaultAllow {
+			return nil
+		}
+		return p.deny("register", "name \"%s\" by default", name)
+	}
+	for _, rule := range p.rules.Register {
+		if matchesUid(rule.Uids, uid) && matchesAny(rule.Names, name) {
+			return nil
+		}
+	}
+	return p.deny("register", "name \"%s\" for %s", name, describeUid(uid))
+}
+
+func matchesUid(uids []uint32, uid *uint32) bool {
+	if len(uids) == 0 {
+		return true
+	}
+	if uid == nil {
+		return false
+	}
+	for _, allowed := range uids {
+		if allowed == *uid {
+			return true
+		}
+	}
+	return false
+}
+
+func describeUid(uid *uint32) string {
+	if uid == nil {
+		return "unknown uid"
+	}
+	return fmt.Sprintf("uid %d", *uid)
+}
+
+func (p *Policy) authorizeType(action string, rules []TypeRule, clientName string, typ types.Type) error {
+	if p == nil {
+		return nil
+	}
+	if len(rules) == 0 {
+		if p.defaultAllow {
+			return nil
+		}
+		return p.deny(action, "type %s for client \"%s\" by default", typ.Name(), clientName)
+	}
+	for _, rule := range rules {
+		if matchesAny(rule.Clients, clientName) && matchesType(rule.Types, typ) {
+			return nil
+		}
+	}
+	return p.deny(action, "type %s for client \"%s\"", typ.Name(), clientName)
+}
+
+func (p *Policy) AuthorizeAcceptType(clientName string, typ types.Type) error {
+	if p == nil {
+		return nil
+	}
+	return p.authorizeType("accept type", p.rules.AcceptType, clientName, typ)
+}
+
+func (p *Policy) AuthorizeGet(clientName string, typ types.Type) error {
+	if p == nil {
+		return nil
+	}
+	return p.authorizeType("get", p.rules.Get, clientName, typ)
+}
+
+// AuthorizeSend Checks whether sender may send typ to target, an unregistered sender has the empty name and only
+// matches rules without sender patterns
+func (p *Policy) AuthorizeSend(sender string, target string, typ types.Type) error {
+	if p == nil {
+		return nil
+	}
+	if len(p.rules.Send) == 0 {
+		if p.defaultAllow {
+			return nil
+		}
+		return p.deny("send", "%s from \"%s\" to \"%s\" by default", typ.Name(), sender, target)
+	}
+	for _, rule := range p.rules.Send {
+		if matchesSender(rule.Senders, sender) && matchesAny(rule.Targets, target) && matchesType(rule.Types, typ) {
+			return nil
+		}
+	}
+	return p.deny("send", "%s from \"%s\" to \"%s\"", typ.Name(), sender, target)
+}
@@ -0,0 +1,127 @@
+package policy
+
+import (
+	"bytes"
+	"github.com/adrianleh/WTMP-middleend/types"
+	"strings"
+	"testing"
+)
+
+const testPolicy = `{
+	"default": "deny",
+	"register": [{"uids": [1000], "names": ["sensor-*"]}, {"names": ["logger"]}],
+	"accept_type": [{"clients": ["logger"], "types": ["Int*"]}],
+	"send": [{"senders": ["sensor-*"], "targets": ["logger"], "types": ["Int32"]}]
+}`
+
+func TestRegister(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var audit bytes.Buffer
+	p.SetAuditLog(&audit)
+	uid, otherUid := uint32(1000), uint32(1001)
+	if err := p.AuthorizeRegister(&uid, "sensor-1"); err != nil {
+		t.Error(err)
+	}
+	if err := p.AuthorizeRegister(&otherUid, "sensor-1"); err == nil {
+		t.Error("Wrong uid should be denied")
+	}
+	if err := p.AuthorizeRegister(nil, "sensor-1"); err == nil {
+		t.Error("Unknown uid should be denied")
+	}
+	if err := p.AuthorizeRegister(nil, "logger"); err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(audit.String(), "uid 1001") {
+		t.Errorf("Denial not audited: %s", audit.String())
+	}
+}
+
+func TestTypesAndSend(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetAuditLog(&bytes.Buffer{})
+	if err := p.AuthorizeAcceptType("logger", types.Int64Type{}); err != nil {
+		t.Error(err)
+	}
+	if err := p.AuthorizeAcceptType("logger", types.CharType{}); err == nil {
+		t.Error("Char should be denied")
+	}
+	if err := p.AuthorizeSend("sensor-2", "logger", types.Int32Type{}); err != nil {
+		t.Error(err)
+	}
+	if err := p.AuthorizeSend("sensor-2", "logger", types.Int64Type{}); err == nil {
+		t.Error("Int64 should be denied")
+	}
+	if err := p.AuthorizeSend("", "logger", types.Int32Type{}); err == nil {
+		t.Error("Unregistered sender should be denied")
+	}
+	if err := p.AuthorizeGet("logger", types.Int32Type{}); err == nil {
+		t.Error("Get has no rules and should fall back to deny")
+	}
+}
+
+func TestNilPolicyAllows(t *testing.T) {
+	var p *Policy
+	if p.AuthorizeRegister(nil, "x") != nil || p.AuthorizeSend("a", "b", types.BoolType{}) != nil {
+		t.Error("nil policy should allow everything")
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	if _, err := Parse([]byte(`{"default": "maybe"}`)); err == nil {
+		t.Error("Should reject default")
+	}
+	if _, err := Parse([]byte(`{"get": [{"types": ["["]}]}`)); err == nil {
+		t.Error("Should reject bad pattern")
+	}
+	if _, err := Parse([]byte(`{"get": [{"types": ["fingerprint:abc"]}]}`)); err == nil {
+		t.Error("Should reject bad fingerprint")
+	}
+}
+
+func TestAmbiguousTypeNames(t *testing.T) {
+	pair := types.UnionType{Members: []types.Type{
+		types.StructType{Fields: []types.Type{types.Int32Type{}}}, types.Int64Type{}}}
+	single := types.UnionType{Members: []types.Type{
+		types.StructType{Fields: []types.Type{types.Int32Type{}, types.Int64Type{}}}}}
+	if pair.Name() != single.Name() {
+		t.Fatalf("Expected %s and %s to share their name", pair.Name(), single.Name())
+	}
+	p, err := Parse([]byte(`{"accept_type": [{"clients": ["byName"], "types": ["` + pair.Name() + `"]},
+		{"clients": ["byFingerprint"], "types": ["fingerprint:` + types.FingerprintOf(pair).String() + `"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetAuditLog(&bytes.Buffer{})
+	if p.AuthorizeAcceptType("byName", pair) != nil || p.AuthorizeAcceptType("byName", single) != nil {
+		t.Error("A name pattern should match every type with that name")
+	}
+	if err := p.AuthorizeAcceptType("byFingerprint", pair); err != nil {
+		t.Error(err)
+	}
+	if err := p.AuthorizeAcceptType("byFingerprint", single); err == nil {
+		t.Error("A fingerprint pattern should only match its type")
+	}
+}
+
+func TestUnregisteredSender(t *testing.T) {
+	p, err := Parse([]byte(`{"send": [{"senders": ["*"], "targets": ["logger"]}, {"targets": ["public"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetAuditLog(&bytes.Buffer{})
+	if err := p.AuthorizeSend("sensor", "logger", types.Int32Type{}); err != nil {
+		t.Error(err)
+	}
+	if err := p.AuthorizeSend("", "logger", types.Int32Type{}); err == nil {
+		t.Error("An unregistered sender should not match a sender pattern")
+	}
+	if err := p.AuthorizeSend("", "public", types.Int32Type{}); err != nil {
+		t.Errorf("An unregistered sender should match a rule without sender patterns, got %v", err)
+	}
+}
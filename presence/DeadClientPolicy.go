@@ -0,0 +1,20 @@
+package presence
+
+import "fmt"
+
+// DeadClientPolicy decides what happens to a client once it is considered dead
+type DeadClientPolicy string
+
+const (
+	KeepDeadClients   = DeadClientPolicy("none")
+	DetachDeadClients = DeadClientPolicy("detach") // Resumable clients start expiring, see broker.WithSessionExpiry
+	RemoveDeadClients = DeadClientPolicy("remove")
+)
+
+func ParseDeadClientPolicy(name string) (DeadClientPolicy, error) {
+	switch policy := DeadClientPolicy(name); policy {
+	case KeepDeadClients, DetachDeadClients, RemoveDeadClients:
+		return policy, nil
+	}
+	return KeepDeadClients, fmt.Errorf("unknown dead client policy \"%s\"", name)
+}
@@ -0,0 +1,168 @@
+package quota
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var violations = expvar.NewMap("quota_violations")
+
+// Limits configures rate limits and resource caps, a zero value disables the respective limit
+type Limits struct {
+	MessagesPerSecond float64 // per sender
+	BytesPerSecond    float64 // per sender
+	MaxAcceptedTypes  uint64  // per receiver
+	MaxQueuedBytes    uint64  // per receiver, across all its queues
+	MaxClients        uint64  // per broker
+	// MessageBurst and ByteBurst Bound how much a sender may send at once after being idle, 0 meaning one second
+	// worth of its rate but at least one message or byte
+	MessageBurst float64
+	ByteBurst    float64
+}
+
+type ExceededError struct {
+	Quota string
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded: %s", e.Quota)
+}
+
+// Exceeded Counts a violation of quota in the quota_violations stats and returns the error to report
+func Exceeded(quota string) error {
+	violations.Add(quota, 1)
+	return &ExceededError{Quota: quota}
+}
+
+// MessageCapacity Returns how many messages a sender may send at once
+func (limits Limits) MessageCapacity() float64 {
+	return capacity(limits.MessagesPerSecond, limits.MessageBurst)
+}
+
+// ByteCapacity Returns how many bytes a sender may send at once, which bounds the size of a single message
+func (limits Limits) ByteCapacity() float64 {
+	return capacity(limits.BytesPerSecond, limits.ByteBurst)
+}
+
+func capacity(rate float64, burst float64) float64 {
+	if burst > 0 {
+		return burst
+	}
+	if rate < 1 {
+		return 1 // Otherwise rates below 1 would never let anything pass
+	}
+	return rate
+}
+
+// TokenBucket Holds up to capacity tokens and refills them continuously at rate tokens per second
+type TokenBucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func NewTokenBucket(rate float64, capacity float64) *TokenBucket {
+	return &TokenBucket{rate: rate, capacity: capacity, tokens: capacity, last: time.Now()}
+}
+
+func (bucket *TokenBucket) refill(now time.Time) {
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.capacity {
+		bucket.tokens = bucket.capacity
+	}
+	bucket.last = now
+}
+
+// SendLimiter Limits the messages and bytes a single sender may send per second
+type SendLimiter struct {
+	messages *TokenBucket // nil if unlimited
+	bytes    *TokenBucket // nil if unlimited
+	mutex    *sync.Mutex
+}
+
+// NewSendLimiter Returns nil if limits has no rate limits, a nil limiter allows everything
+func NewSendLimiter(limits Limits) *SendLimiter {
+	if limits.MessagesPerSecond <= 0 && limits.BytesPerSecond <= 0 {
+		return nil
+	}
+	limiter := &SendLimiter{mutex: &sync.Mutex{}}
+	if limits.MessagesPerSecond > 0 {
+		limiter.messages = NewTokenBucket(limits.MessagesPerSecond, limits.MessageCapacity())
+	}
+	if limits.BytesPerSecond > 0 {
+		limiter.bytes = NewTokenBucket(limits.BytesPerSecond, limits.ByteCapacity())
+	}
+	return limiter
+}
+
+// Allow Takes one message and size bytes worth of tokens, taking nothing if either bucket is short
+func (limiter *SendLimiter) Allow(size uint64) error {
+	if limiter == nil {
+		return nil
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if err := limiter.check(size); err != nil {
+		return err
+	}
+	limiter.take(size)
+	return nil
+}
+
+// Check Tells whether messages of sizes could all be sent now, without taking any tokens
+func (limiter *SendLimiter) Check(sizes ...uint64) error {
+	if limiter == nil {
+		return nil
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return limiter.check(sizes...)
+}
+
+// Take Takes the tokens of messages of sizes once they were sent after Check allowed them. Sends in between may
+// leave the buckets short, which only delays later sends.
+func (limiter *SendLimiter) Take(sizes ...uint64) {
+	if limiter == nil {
+		return
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.take(sizes...)
+}
+
+func (limiter *SendLimiter) check(sizes ...uint64) error {
+	now := time.Now()
+	if limiter.messages != nil {
+		limiter.messages.refill(now)
+		if limiter.messages.tokens < float64(len(sizes)) {
+			return Exceeded("messages_per_second")
+		}
+	}
+	if limiter.bytes != nil {
+		limiter.bytes.refill(now)
+		if limiter.bytes.tokens < float64(total(sizes)) {
+			return Exceeded("bytes_per_second")
+		}
+	}
+	return nil
+}
+
+func (limiter *SendLimiter) take(sizes ...uint64) {
+	if limiter.messages != nil {
+		limiter.messages.tokens -= float64(len(sizes))
+	}
+	if limiter.bytes != nil {
+		limiter.bytes.tokens -= float64(total(sizes))
+	}
+}
+
+func total(sizes []uint64) uint64 {
+	sum := uint64(0)
+	for _, size := range sizes {
+		sum += size
+	}
+	return sum
+}
@@ -0,0 +1,84 @@
+package quota
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageRate(t *testing.T) {
+	limiter := NewSendLimiter(Limits{MessagesPerSecond: 2})
+	for i := 0; i < 2; i++ {
+		if err := limiter.Allow(100); err != nil {
+			t.Errorf("Message %d should pass: %v", i, err)
+		}
+	}
+	if err := limiter.Allow(100); err == nil {
+		t.Error("Third message should be limited")
+	}
+	time.Sleep(600 * time.Millisecond)
+	if err := limiter.Allow(100); err != nil {
+		t.Errorf("Bucket should have refilled: %v", err)
+	}
+}
+
+func TestByteRate(t *testing.T) {
+	limiter := NewSendLimiter(Limits{MessagesPerSecond: 100, BytesPerSecond: 10})
+	if err := limiter.Allow(8); err != nil {
+		t.Error(err)
+	}
+	if err := limiter.Allow(8); err == nil {
+		t.Error("Should exceed byte rate")
+	}
+	if err := limiter.Allow(2); err != nil {
+		t.Errorf("Rejected message must not consume tokens: %v", err)
+	}
+}
+
+func TestSlowRate(t *testing.T) {
+	limiter := NewSendLimiter(Limits{MessagesPerSecond: 0.5})
+	if err := limiter.Allow(100); err != nil {
+		t.Errorf("Rates below one message per second should still let a message pass: %v", err)
+	}
+	if err := limiter.Allow(100); err == nil {
+		t.Error("Second message should be limited")
+	}
+}
+
+func TestBurst(t *testing.T) {
+	limiter := NewSendLimiter(Limits{MessagesPerSecond: 1, BytesPerSecond: 10, ByteBurst: 100, MessageBurst: 3})
+	for i := 0; i < 3; i++ {
+		if err := limiter.Allow(30); err != nil {
+			t.Errorf("Message %d should pass within the burst: %v", i, err)
+		}
+	}
+	if err := limiter.Allow(1); err == nil {
+		t.Error("Fourth message should exceed the burst")
+	}
+}
+
+func TestCheckThenTake(t *testing.T) {
+	limiter := NewSendLimiter(Limits{MessagesPerSecond: 2, BytesPerSecond: 10})
+	if err := limiter.Check(4, 4, 4); err == nil {
+		t.Error("Three messages should exceed the message rate")
+	}
+	if err := limiter.Check(8, 8); err == nil {
+		t.Error("Sixteen bytes should exceed the byte rate")
+	}
+	if err := limiter.Check(4, 4); err != nil {
+		t.Fatalf("Checks must not take tokens: %v", err)
+	}
+	limiter.Take(4, 4)
+	if err := limiter.Allow(1); err == nil {
+		t.Error("Taken tokens should be gone")
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	limiter := NewSendLimiter(Limits{MaxClients: 3})
+	if limiter != nil {
+		t.Error("Limiter without rates should be nil")
+	}
+	if err := limiter.Allow(1 << 30); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,170 @@
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// probeTimeout Bounds how long we wait for a broker that might still own an existing socket file
+const probeTimeout = 500 * time.Millisecond
+
+type Permissions struct {
+	Mode  os.FileMode
+	Owner string // user name or numeric uid, empty to keep the current one
+	Group string // group name or numeric gid, empty to keep the current one
+}
+
+// IsAbstract Reports whether path names a Linux abstract-namespace socket, written with a leading '@'
+func IsAbstract(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// Listen Listens on the unix socket at path.
+// A socket file left behind by a crashed broker is removed, while a socket some live process still accepts on is
+// reported as an error. Permissions are applied to the socket file, abstract sockets have none.
+func Listen(path string, perm Permissions) (net.Listener, error) {
+	if IsAbstract(path) {
+		if runtime.GOOS != "linux" {
+			return nil, fmt.Errorf("abstract socket \"%s\" is only supported on linux", path)
+		}
+		return net.Listen("unix", path)
+	}
+	if err := removeStale(path); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyPermissions(path, perm); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func removeStale(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("\"%s\" exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, probeTimeout)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("another broker is listening on \"%s\"", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("cannot tell whether \"%s\" is stale: %v", path, err)
+	}
+	return os.Remove(path)
+}
+
+func applyPermissions(path string, perm Permissions) error {
+	uid, gid := -1, -1
+	if perm.Owner != "" {
+		id, err := lookupId(perm.Owner, func(name string) (string, error) {
+			usr, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return usr.Uid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("socket owner: %v", err)
+		}
+		uid = id
+	}
+	if perm.Group != "" {
+		id, err := lookupId(perm.Group, func(name string) (string, error) {
+			grp, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return grp.Gid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("socket group: %v", err)
+		}
+		gid = id
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(path, perm.Mode)
+}
+
+// lookupId Accepts numeric ids as is and resolves names with lookup
+func lookupId(nameOrId string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrId); err == nil {
+		return id, nil
+	}
+	idStr, err := lookup(nameOrId)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(idStr)
+}
+
+// listenFdsStart is the first file descriptor passed by socket activation (SD_LISTEN_FDS_START)
+const listenFdsStart = 3
+
+// ActivationListeners Returns the listeners passed by systemd style socket activation through LISTEN_PID and
+// LISTEN_FDS, or nil if the process was not socket activated. The variables are unset so children don't inherit them.
+func ActivationListeners() ([]net.Listener, error) {
+	pidStr, fdsStr := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if pidStr == "" || fdsStr == "" {
+		return nil, nil
+	}
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_PID: %v", err)
+	}
+	if pid != os.Getpid() {
+		return nil, nil // Meant for another process
+	}
+	noFds, err := strconv.Atoi(fdsStr)
+	if err != nil || noFds < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS \"%s\"", fdsStr)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	listeners := make([]net.Listener, 0, noFds)
+	for i := 0; i < noFds; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := fmt.Sprintf("LISTEN_FD_%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close() // FileListener dups the descriptor
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("activation fd %d: %v", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
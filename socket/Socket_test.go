@@ -0,0 +1,89 @@
+package socket
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestStaleSocketRemoved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stale.sock")
+	old, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.(*net.UnixListener).SetUnlinkOnClose(false) // Simulate a crash leaving the file behind
+	old.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Socket file should be left behind: %v", err)
+	}
+
+	listener, err := Listen(path, Permissions{Mode: 0600})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer listener.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Wrong mode %o", info.Mode().Perm())
+	}
+}
+
+func TestLiveSocketKept(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "live.sock")
+	live, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	if listener, err := Listen(path, Permissions{Mode: 0600}); err == nil {
+		listener.Close()
+		t.Error("Should refuse to replace a live socket")
+	}
+}
+
+func TestNonSocketKept(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "regular")
+	if err := ioutil.WriteFile(path, []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if listener, err := Listen(path, Permissions{Mode: 0600}); err == nil {
+		listener.Close()
+		t.Error("Should refuse to replace a regular file")
+	}
+}
+
+func TestAbstractSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are linux only")
+	}
+	listener, err := Listen("@wtmp-test-abstract", Permissions{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer listener.Close()
+	conn, err := net.Dial("unix", "@wtmp-test-abstract")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	conn.Close()
+}
+
+func TestNoActivation(t *testing.T) {
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	listeners, err := ActivationListeners()
+	if err != nil || listeners != nil {
+		t.Errorf("Expected no listeners, got %v, %v", listeners, err)
+	}
+}
@@ -0,0 +1,241 @@
+package types
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+const (
+	// MaxDepth bounds how deeply structs, unions and arrays may be nested in a serialized type
+	MaxDepth = 32
+	// MaxFields bounds the number of fields of a struct and members of a union
+	MaxFields = 1024
+)
+
+// DecodeError reports why a serialized type is malformed and the byte offset the problem was found at
+type DecodeError struct {
+	Offset int
+	Reason string
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("malformed type at byte %d: %s", e.Offset, e.Reason)
+}
+
+func decodeError(offset int, format string, args ...interface{}) *DecodeError {
+	return &DecodeError{Offset: offset, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Deserialize Decodes a serialized type. Every length prefix is checked against the data it claims to cover,
+// raw must hold exactly one type and nesting is bounded by MaxDepth and MaxFields. Errors are *DecodeError.
+// References are resolved by KnownTypes.Deserialize only.
+func Deserialize(raw []byte) (Type, error) {
+	if isReference(raw) {
+		return nil, decodeError(4, "type reference without known types")
+	}
+	typ, end, err := decode(raw, 0, len(raw), 0)
+	if err != nil {
+		return nil, err
+	}
+	if end != len(raw) {
+		return nil, decodeError(end, "%d trailing bytes", len(raw)-end)
+	}
+	return typ, nil
+}
+
+// deserializeAs Decodes raw like Deserialize and checks that it holds a type with typId
+func deserializeAs(typId byte, raw []byte) (Type, error) {
+	typ, err := Deserialize(raw)
+	if err != nil {
+		return nil, err
+	}
+	if typ.typId() != typId {
+		return nil, decodeError(4, "expected type id %d, got %d", typId, typ.typId())
+	}
+	return typ, nil
+}
+
+// decode Decodes the type starting at offset that must end at or before limit, returning where it ends
+func decode(raw []byte, offset int, limit int, depth int) (Type, int, error) {
+	if limit-offset < 5 {
+		return nil, 0, decodeError(offset, "need 5 bytes for length and type id, %d left", limit-offset)
+	}
+	length := binary.BigEndian.Uint32(raw[offset : offset+4])
+	if length < 5 {
+		return nil, 0, decodeError(offset, "declared length %d is shorter than length and type id", length)
+	}
+	if uint64(length) > uint64(limit-offset) {
+		return nil, 0, decodeError(offset, "declared length %d exceeds the %d bytes available", length, limit-offset)
+	}
+	end := offset + int(length)
+	typId := raw[offset+4]
+	switch typId {
+	case charTypeId, int32TypeId, int64TypeId, float32TypeId, float64TypeId, boolTypeId, cCharTypeId:
+		if length != 5 {
+			return nil, 0, decodeError(offset, "primitive type of length %d", length)
+		}
+		return primitiveTypes[typId], end, nil
+	case taggedUnionTypeId:
+		members, err := decodeFields(raw, offset, end, depth)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(members) == 0 {
+			return nil, 0, decodeError(offset, "tagged union without members")
+		}
+		return TaggedUnionType{Members: members}, end, nil
+	case layoutStructTypeId:
+		if depth >= MaxDepth {
+			return nil, 0, decodeError(offset, "nested deeper than %d", MaxDepth)
+		}
+		if end-offset < 6 {
+			return nil, 0, decodeError(offset, "laid out struct needs 6 bytes, has %d", end-offset)
+		}
+		if Layout(raw[offset+5]) != CLayout {
+			return nil, 0, decodeError(offset+5, "unknown layout %d", raw[offset+5])
+		}
+		inner, innerEnd, err := decode(raw, offset+6, end, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		if innerEnd != end {
+			return nil, 0, decodeError(innerEnd, "%d bytes after the laid out struct", end-innerEnd)
+		}
+		structType, isStruct := inner.(StructType)
+		if !isStruct || structType.Layout != PackedLayout {
+			return nil, 0, decodeError(offset+6, "only structs without a layout can be laid out")
+		}
+		for i, field := range structType.Fields {
+			if !cCompatible(field) {
+				return nil, 0, decodeError(offset+6, "field %d cannot be laid out like C", i)
+			}
+		}
+		structType.Layout = CLayout
+		if _, _, ok := structType.cLayout(); !ok {
+			return nil, 0, decodeError(offset, "struct size overflows")
+		}
+		return structType, end, nil
+	case namedStructTypeId:
+		names, fields, err := decodeNamedFields(raw, offset, end, depth)
+		if err != nil {
+			return nil, 0, err
+		}
+		if overflows(fields) {
+			return nil, 0, decodeError(offset, "struct size overflows")
+		}
+		return StructType{Fields: fields, Names: names}, end, nil
+	case structTypeId, unionTypeId:
+		fields, err := decodeFields(raw, offset, end, depth)
+		if err != nil {
+			return nil, 0, err
+		}
+		if typId == structTypeId {
+			if overflows(fields) {
+				return nil, 0, decodeError(offset, "struct size overflows")
+			}
+			return StructType{Fields: fields}, end, nil
+		}
+		for i, member := range fields {
+			if !FixedSize(member) {
+				return nil, 0, decodeError(offset, "member %d of a union has a variable size", i)
+			}
+		}
+		return UnionType{Members: fields}, end, nil
+	case arrayTypeId:
+		if depth >= MaxDepth {
+			return nil, 0, decodeError(offset, "nested deeper than %d", MaxDepth)
+		}
+		if end-offset < 13 {
+			return nil, 0, decodeError(offset, "array needs 13 bytes, has %d", end-offset)
+		}
+		arrLength := binary.BigEndian.Uint64(raw[offset+5 : offset+13])
+		inner, innerEnd, err := decode(raw, offset+13, end, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		if innerEnd != end {
+			return nil, 0, decodeError(innerEnd, "%d bytes after the array's element type", end-innerEnd)
+		}
+		if size := inner.Size(); size != 0 && arrLength > math.MaxUint64/size {
+			return nil, 0, decodeError(offset+5, "array of %d elements overflows its size", arrLength)
+		}
+		return ArrayType{Length: arrLength, Typ: inner}, end, nil
+	case stringTypeId, bytesTypeId:
+		if length != 9 {
+			return nil, 0, decodeError(offset, "string type of length %d", length)
+		}
+		maxLength := binary.BigEndian.Uint32(raw[offset+5 : offset+9])
+		if typId == stringTypeId {
+			return StringType{MaxLength: maxLength}, end, nil
+		}
+		return BytesType{MaxLength: maxLength}, end, nil
+	case listTypeId:
+		if depth >= MaxDepth {
+			return nil, 0, decodeError(offset, "nested deeper than %d", MaxDepth)
+		}
+		if end-offset < 9 {
+			return nil, 0, decodeError(offset, "list needs 9 bytes, has %d", end-offset)
+		}
+		maxLength := binary.BigEndian.Uint32(raw[offset+5 : offset+9])
+		inner, innerEnd, err := decode(raw, offset+9, end, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		if innerEnd != end {
+			return nil, 0, decodeError(innerEnd, "%d bytes after the list's element type", end-innerEnd)
+		}
+		return ListType{MaxLength: maxLength, Typ: inner}, end, nil
+	}
+	return nil, 0, decodeError(offset+4, "unknown type id %d", typId)
+}
+
+// overflows Tells whether the size of a struct of fields overflows
+func overflows(fields []Type) bool {
+	size := uint64(0)
+	for _, field := range fields {
+		if size+field.Size() < size {
+			return true
+		}
+		size += field.Size()
+	}
+	return false
+}
+
+// decodeFields Decodes the fields of the struct or union at offset
+func decodeFields(raw []byte, offset int, end int, depth int) ([]Type, error) {
+	if depth >= MaxDepth {
+		return nil, decodeError(offset, "nested deeper than %d", MaxDepth)
+	}
+	if end-offset < 9 {
+		return nil, decodeError(offset, "struct or union needs 9 bytes, has %d", end-offset)
+	}
+	noFields := binary.BigEndian.Uint32(raw[offset+5 : offset+9])
+	if noFields > MaxFields {
+		return nil, decodeError(offset+5, "%d fields exceed the maximum of %d", noFields, MaxFields)
+	}
+	var fields []Type
+	pos := offset + 9
+	for i := uint32(0); i < noFields; i++ {
+		field, fieldEnd, err := decode(raw, pos, end, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+		pos = fieldEnd
+	}
+	if pos != end {
+		return nil, decodeError(pos, "%d bytes after the last field", end-pos)
+	}
+	return fields, nil
+}
+
+var primitiveTypes = map[byte]Type{
+	charTypeId:    CharType{},
+	int32TypeId:   Int32Type{},
+	int64TypeId:   Int64Type{},
+	float32TypeId: Float32Type{},
+	float64TypeId: Float64Type{},
+	boolTypeId:    BoolType{},
+	cCharTypeId:   CCharType{},
+}
@@ -0,0 +1,88 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestDeserializeRejectsMalformed(t *testing.T) {
+	valid := StructType{Fields: []Type{Int32Type{}, ArrayType{Length: 3, Typ: CharType{}}}}.Serialize()
+	unknownField := append([]byte{}, valid...)
+	unknownField[9+4] = 42
+	truncated := valid[:len(valid)-1]
+	lyingLength := append([]byte{}, valid...)
+	binary.BigEndian.PutUint32(lyingLength[0:4], 1000)
+	tooManyFields := append([]byte{}, valid...)
+	binary.BigEndian.PutUint32(tooManyFields[5:9], MaxFields+1)
+	shortArray := []byte{0, 0, 0, 9, arrayTypeId, 0, 0, 0, 1}
+	arrayWithSlack := append(ArrayType{Length: 1, Typ: CharType{}}.Serialize(), 0)
+	binary.BigEndian.PutUint32(arrayWithSlack[0:4], uint32(len(arrayWithSlack)))
+
+	cases := map[string][]byte{
+		"empty":              {},
+		"unknown id":         {0, 0, 0, 5, 42},
+		"unknown field id":   unknownField,
+		"truncated":          truncated,
+		"lying length":       lyingLength,
+		"too many fields":    tooManyFields,
+		"short array":        shortArray,
+		"array with slack":   arrayWithSlack,
+		"trailing bytes":     append(Int32Type{}.Serialize(), 0),
+		"primitive too long": {0, 0, 0, 6, int32TypeId, 0},
+		"zero length":        {0, 0, 0, 0, int32TypeId},
+	}
+	for name, raw := range cases {
+		typ, err := Deserialize(raw)
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) {
+			t.Errorf("%s: expected a DecodeError, got %v (%v)", name, err, typ)
+		}
+	}
+}
+
+func TestDeserializeBoundsDepth(t *testing.T) {
+	var typ Type = Int32Type{}
+	for i := 0; i < MaxDepth; i++ {
+		typ = StructType{Fields: []Type{typ}}
+	}
+	if _, err := Deserialize(typ.Serialize()); err != nil {
+		t.Errorf("Depth of %d should be fine: %v", MaxDepth, err)
+	}
+	typ = ArrayType{Length: 1, Typ: typ}
+	if _, err := Deserialize(typ.Serialize()); err == nil {
+		t.Error("Should reject nesting deeper than MaxDepth")
+	}
+}
+
+func TestDeserializeReportsOffset(t *testing.T) {
+	raw := StructType{Fields: []Type{Int32Type{}, Int64Type{}}}.Serialize()
+	raw[9+5+4] = 42 // Type id of the second field
+	var decodeErr *DecodeError
+	if _, err := Deserialize(raw); !errors.As(err, &decodeErr) || decodeErr.Offset != 9+5+4 {
+		t.Errorf("Expected an error at byte %d, got %v", 9+5+4, err)
+	}
+}
+
+func FuzzDeserialize(f *testing.F) {
+	f.Add(Int32Type{}.Serialize())
+	f.Add(StructType{Fields: []Type{CharType{}, BoolType{}}}.Serialize())
+	f.Add(UnionType{Members: []Type{Float32Type{}, Float64Type{}}}.Serialize())
+	f.Add(ArrayType{Length: 4, Typ: StructType{Fields: []Type{Int64Type{}}}}.Serialize())
+	f.Add(ListType{MaxLength: 8, Typ: StructType{Fields: []Type{StringType{}, BytesType{}}}}.Serialize())
+	f.Add(TaggedUnionType{Members: []Type{Int32Type{}, ListType{Typ: CharType{}}}}.Serialize())
+	f.Add(StructType{Fields: []Type{Int32Type{}, StringType{}}, Names: []string{"id", "label"}}.Serialize())
+	f.Add(StructType{Fields: []Type{BoolType{}, Int64Type{}}, Layout: CLayout}.Serialize())
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		typ, err := Deserialize(raw)
+		if err != nil || raw[4] == referenceTypeId {
+			return
+		}
+		_ = typ.Name()
+		_ = typ.Size()
+		if !bytes.Equal(typ.Serialize(), raw) {
+			t.Errorf("%s does not serialize to its input", typ.Name())
+		}
+	})
+}
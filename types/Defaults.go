@@ -0,0 +1,138 @@
+package types
+
+import "fmt"
+
+// Defaults Holds default values for the fields of a struct, so that payloads of older versions of the struct, which
+// lack some of its fields, can be extended to it. Positional structs can lack trailing fields, named structs any.
+type Defaults struct {
+	Typ     StructType
+	Payload []byte // A payload of Typ
+	packed  []byte // Payload without the layout of Typ
+	spans   []span // Where each field is in packed
+}
+
+func CreateDefaults(typ StructType, payload []byte) (*Defaults, error) {
+	if err := Validate(typ, payload); err != nil {
+		return nil, err
+	}
+	packed := payload
+	if typ.Layout == CLayout {
+		var err error
+		if packed, err = fromC(typ, payload, 0); err != nil {
+			return nil, err
+		}
+	}
+	spans, err := fieldSpans(typ.packed(), packed)
+	if err != nil {
+		return nil, err
+	}
+	return &Defaults{Typ: typ, Payload: payload, packed: packed, spans: spans}, nil
+}
+
+// CanExtend Tells whether payloads of typ can be extended with the defaults: typ must be a struct lacking some of
+// the fields of the defaults' struct, its other fields being subtypes of the fields they stand for. widen lets
+// numbers be widened as for IsWideningSubtype.
+func (defaults *Defaults) CanExtend(typ Type, widen bool) bool {
+	_, ok := defaults.sources(typ, widen)
+	return ok
+}
+
+// Extend Projects data, a payload of typ, to the fields of the defaults' struct it has and fills in the defaults
+// of the fields it lacks
+func (defaults *Defaults) Extend(typ Type, data []byte, widen bool) ([]byte, error) {
+	sources, ok := defaults.sources(typ, widen)
+	if !ok {
+		return nil, fmt.Errorf("%s cannot be extended to %s", typ.Name(), defaults.Typ.Name())
+	}
+	structType := typ.(StructType)
+	if err := checkPayloadSize(structType, data); err != nil {
+		return nil, err
+	}
+	if structType.Layout == CLayout {
+		var err error
+		if data, err = fromC(structType, data, 0); err != nil {
+			return nil, err
+		}
+		structType = structType.packed()
+	}
+	spans, err := fieldSpans(structType, data)
+	if err != nil {
+		return nil, err
+	}
+	fields := make([][]byte, len(sources))
+	for i, source := range sources {
+		if source < 0 {
+			fields[i] = defaults.packed[defaults.spans[i].start:defaults.spans[i].end]
+			continue
+		}
+		field := data[spans[source].start:spans[source].end]
+		if fields[i], err = project(structType.Fields[source], defaults.Typ.Fields[i], field, widen); err != nil {
+			return nil, err
+		}
+	}
+	if defaults.Typ.Layout == CLayout {
+		return toC(defaults.Typ, assemble(fields))
+	}
+	return assemble(fields), nil
+}
+
+// sources Returns for each field of the defaults' struct the index of the field of typ it is projected from, -1 if
+// its default is used. At least one default has to be used, otherwise typ is a subtype, not an older version.
+func (defaults *Defaults) sources(typ Type, widen bool) ([]int, bool) {
+	structType, isStruct := typ.(StructType)
+	if !isStruct || defaults.Typ.named() != structType.named() {
+		return nil, false
+	}
+	sources := make([]int, len(defaults.Typ.Fields))
+	missing := false
+	for i, field := range defaults.Typ.Fields {
+		sources[i] = i
+		if defaults.Typ.named() {
+			sources[i] = structType.fieldIndex(defaults.Typ.Names[i])
+		} else if i >= len(structType.Fields) {
+			sources[i] = -1
+		}
+		if sources[i] < 0 {
+			missing = true
+		} else if !isSubtype(structType.Fields[sources[i]], field, widen) {
+			return nil, false
+		}
+	}
+	return sources, missing
+}
+
+// Compatibility Tells how receivers and senders of two versions of a type can be mixed
+type Compatibility struct {
+	// Backward Receivers of the new version accept messages of the old one
+	Backward bool
+	// Forward Receivers of the old version accept messages of the new one
+	Forward bool
+}
+
+// CheckCompatibility Compares two versions of a type. Compatibility through defaults assumes receivers register
+// defaults for the fields of the structs they accept.
+func CheckCompatibility(oldTyp Type, newTyp Type) Compatibility {
+	return Compatibility{
+		Backward: IsSubtype(oldTyp, newTyp) || extensible(oldTyp, newTyp),
+		Forward:  IsSubtype(newTyp, oldTyp) || extensible(newTyp, oldTyp),
+	}
+}
+
+// extensible Tells whether payloads of typ can be extended to target given defaults for target
+func extensible(typ Type, target Type) bool {
+	targetStruct, isStruct := target.(StructType)
+	return isStruct && (&Defaults{Typ: targetStruct}).CanExtend(typ, false)
+}
+
+// String Describes the compatibility the way schema registries do
+func (c Compatibility) String() string {
+	switch {
+	case c.Backward && c.Forward:
+		return "full"
+	case c.Backward:
+		return "backward"
+	case c.Forward:
+		return "forward"
+	}
+	return "none"
+}
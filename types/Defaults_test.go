@@ -0,0 +1,55 @@
+package types
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExtendWithDefaults(t *testing.T) {
+	v2 := StructType{Fields: []Type{Int32Type{}, StringType{}, BoolType{}}}
+	defaults, err := CreateDefaults(v2, []byte{0, 0, 0, 0, 0, 0, 0, 2, 'n', 'a', 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateDefaults(v2, []byte{0, 0, 0, 0}); err == nil {
+		t.Error("Defaults must be a payload of the struct")
+	}
+
+	v1 := StructType{Fields: []Type{Int32Type{}}}
+	extended, err := defaults.Extend(v1, []byte{0, 0, 0, 7}, false)
+	if err != nil || !bytes.Equal(extended, []byte{0, 0, 0, 7, 0, 0, 0, 2, 'n', 'a', 1}) {
+		t.Errorf("Wrong extension %v %v", extended, err)
+	}
+	if defaults.CanExtend(v2, false) || defaults.CanExtend(StructType{Fields: []Type{CharType{}}}, false) {
+		t.Error("Only shorter structs with matching fields can be extended")
+	}
+	v1Narrow := StructType{Fields: []Type{Int32Type{}}}
+	v2Wide := StructType{Fields: []Type{Int64Type{}, BoolType{}}}
+	wideDefaults, _ := CreateDefaults(v2Wide, make([]byte, 9))
+	if wideDefaults.CanExtend(v1Narrow, false) || !wideDefaults.CanExtend(v1Narrow, true) {
+		t.Error("Extension should widen only when asked to")
+	}
+	if extended, err := wideDefaults.Extend(v1Narrow, []byte{0, 0, 0, 3}, true); err != nil || len(extended) != 9 {
+		t.Errorf("Wrong widened extension %v %v", extended, err)
+	}
+}
+
+func TestCheckCompatibility(t *testing.T) {
+	v1 := StructType{Fields: []Type{Int32Type{}}}
+	v2 := StructType{Fields: []Type{Int32Type{}, StringType{}}}
+	for _, c := range []struct {
+		oldTyp, newTyp Type
+		expected       string
+	}{
+		{v1, v1, "full"},
+		{v1, v2, "full"},
+		{v2, v1, "full"},
+		{v1, StructType{Fields: []Type{CharType{}, StringType{}}}, "none"},
+		{StructType{Fields: []Type{v1}}, StructType{Fields: []Type{v2}}, "forward"},
+		{UnionType{Members: []Type{Int32Type{}}}, UnionType{Members: []Type{Int32Type{}, Int64Type{}}}, "backward"},
+	} {
+		if compatibility := CheckCompatibility(c.oldTyp, c.newTyp).String(); compatibility != c.expected {
+			t.Errorf("%s to %s should be %s, got %s", c.oldTyp.Name(), c.newTyp.Name(), c.expected, compatibility)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package types
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+)
+
+// Fingerprint identifies a type by its structure. Unlike Name(), which is meant for display and is ambiguous for
+// nested structs and unions, two types have the same fingerprint exactly when they have the same canonical encoding.
+type Fingerprint [sha256.Size]byte
+
+// Canonical Returns the canonical encoding of typ. It is injective as every type and field is length prefixed,
+// so it doubles as the wire serialization.
+func Canonical(typ Type) []byte {
+	return typ.Serialize()
+}
+
+func FingerprintOf(typ Type) Fingerprint {
+	return sha256.Sum256(Canonical(typ))
+}
+
+func (fp Fingerprint) String() string {
+	return hex.EncodeToString(fp[:])
+}
+
+// Same Tells whether a and b are the same type, i.e. have the same fingerprint, comparing their structure instead
+// of hashing it
+func Same(a Type, b Type) bool {
+	if a.typId() != b.typId() {
+		return false
+	}
+	switch a := a.(type) {
+	case StructType:
+		b := b.(StructType)
+		return a.Layout == b.Layout && a.named() == b.named() && sameNames(a.Names, b.Names) &&
+			sameTypes(a.Fields, b.Fields)
+	case UnionType:
+		return sameTypes(a.Members, b.(UnionType).Members)
+	case TaggedUnionType:
+		return sameTypes(a.Members, b.(TaggedUnionType).Members)
+	case ArrayType:
+		b := b.(ArrayType)
+		return a.Length == b.Length && Same(a.Typ, b.Typ)
+	case ListType:
+		b := b.(ListType)
+		return a.MaxLength == b.MaxLength && Same(a.Typ, b.Typ)
+	case StringType:
+		return a.MaxLength == b.(StringType).MaxLength
+	case BytesType:
+		return a.MaxLength == b.(BytesType).MaxLength
+	}
+	return true
+}
+
+func sameTypes(a []Type, b []Type) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !Same(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameNames(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// referenceTypeId marks a type reference: the length (4), the id and a fingerprint standing in for a known type
+const referenceTypeId = 0xFF
+
+// ReferenceLength is the length of a serialized type reference
+const ReferenceLength = 4 + 1 + sha256.Size
+
+// Reference Serializes a reference to typ, which KnownTypes.Deserialize resolves once typ is remembered
+func Reference(typ Type) []byte {
+	fp := FingerprintOf(typ)
+	raw := make([]byte, 5, ReferenceLength)
+	binary.BigEndian.PutUint32(raw[0:4], ReferenceLength)
+	raw[4] = referenceTypeId
+	return append(raw, fp[:]...)
+}
+
+// KnownTypes Resolves references to the types it remembers. Each type is remembered until it was forgotten as often
+// as it was remembered, e.g. once per client accepting it.
+type KnownTypes struct {
+	types  map[Fingerprint]Type
+	counts map[Fingerprint]int
+	mutex  *sync.RWMutex
+}
+
+func CreateKnownTypes() *KnownTypes {
+	return &KnownTypes{
+		types:  map[Fingerprint]Type{},
+		counts: map[Fingerprint]int{},
+		mutex:  &sync.RWMutex{},
+	}
+}
+
+// Remember Lets references to typ be resolved, e.g. because a client accepts it
+func (known *KnownTypes) Remember(typ Type) {
+	fp := FingerprintOf(typ)
+	known.mutex.Lock()
+	defer known.mutex.Unlock()
+	known.types[fp] = typ
+	known.counts[fp]++
+}
+
+// Forget Undoes one Remember of typ
+func (known *KnownTypes) Forget(typ Type) {
+	fp := FingerprintOf(typ)
+	known.mutex.Lock()
+	defer known.mutex.Unlock()
+	if known.counts[fp] <= 1 {
+		delete(known.types, fp)
+		delete(known.counts, fp)
+		return
+	}
+	known.counts[fp]--
+}
+
+// Len Returns the number of distinct types remembered
+func (known *KnownTypes) Len() int {
+	known.mutex.RLock()
+	defer known.mutex.RUnlock()
+	return len(known.types)
+}
+
+// Deserialize Decodes a serialized type like the package's Deserialize, raw may also be a Reference to a
+// remembered type
+func (known *KnownTypes) Deserialize(raw []byte) (Type, error) {
+	if !isReference(raw) {
+		return Deserialize(raw)
+	}
+	if len(raw) != ReferenceLength || binary.BigEndian.Uint32(raw[0:4]) != ReferenceLength {
+		return nil, decodeError(0, "type reference must be %d bytes", ReferenceLength)
+	}
+	var fp Fingerprint
+	copy(fp[:], raw[5:])
+	known.mutex.RLock()
+	defer known.mutex.RUnlock()
+	typ := known.types[fp]
+	if typ == nil {
+		return nil, decodeError(5, "unknown type %s", fp)
+	}
+	return typ, nil
+}
+
+func isReference(raw []byte) bool {
+	return len(raw) >= 5 && raw[4] == referenceTypeId
+}
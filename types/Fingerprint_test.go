@@ -0,0 +1,71 @@
+package types
+
+import (
+	"testing"
+)
+
+func TestFingerprintDistinguishesNesting(t *testing.T) {
+	emptyThenInt := StructType{Fields: []Type{StructType{}, Int32Type{}}}
+	nested := StructType{Fields: []Type{StructType{Fields: []Type{Int32Type{}}}}}
+	if emptyThenInt.Name() != nested.Name() {
+		t.Fatalf("Expected the names to collide, got %s and %s", emptyThenInt.Name(), nested.Name())
+	}
+	if FingerprintOf(emptyThenInt) == FingerprintOf(nested) {
+		t.Error("Distinct types must have distinct fingerprints")
+	}
+	if FingerprintOf(nested) != FingerprintOf(StructType{Fields: []Type{StructType{Fields: []Type{Int32Type{}}}}}) {
+		t.Error("Fingerprints must be stable")
+	}
+}
+
+func TestReference(t *testing.T) {
+	typ := StructType{Fields: []Type{Float64Type{}, ArrayType{Length: 7, Typ: BoolType{}}}}
+	known := CreateKnownTypes()
+	if _, err := known.Deserialize(Reference(typ)); err == nil {
+		t.Error("Unknown reference should not resolve")
+	}
+	known.Remember(typ)
+	known.Remember(typ)
+	resolved, err := known.Deserialize(Reference(typ))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Same(resolved, typ) {
+		t.Errorf("Resolved to %s", resolved.Name())
+	}
+	if _, err := Deserialize(Reference(typ)); err == nil {
+		t.Error("Deserialize should not resolve references")
+	}
+	known.Forget(typ)
+	if _, err := known.Deserialize(Reference(typ)); err != nil {
+		t.Errorf("Type remembered twice should resolve until forgotten twice, got %v", err)
+	}
+	known.Forget(typ)
+	if _, err := known.Deserialize(Reference(typ)); err == nil {
+		t.Error("Forgotten type should not resolve")
+	}
+	if known.Len() != 0 {
+		t.Errorf("Expected no known types, got %d", known.Len())
+	}
+}
+
+func TestSameAgreesWithFingerprints(t *testing.T) {
+	typs := []Type{
+		Int32Type{}, Int64Type{}, CharType{}, CCharType{},
+		StructType{}, StructType{Names: []string{}}, StructType{Fields: []Type{Int32Type{}}},
+		StructType{Fields: []Type{Int32Type{}}, Names: []string{"a"}},
+		StructType{Fields: []Type{Int32Type{}}, Names: []string{"b"}},
+		StructType{Fields: []Type{Int32Type{}}, Layout: CLayout},
+		UnionType{Members: []Type{Int32Type{}, BoolType{}}}, TaggedUnionType{Members: []Type{Int32Type{}, BoolType{}}},
+		ArrayType{Length: 2, Typ: Int32Type{}}, ArrayType{Length: 3, Typ: Int32Type{}},
+		ListType{Typ: Int32Type{}}, ListType{MaxLength: 4, Typ: Int32Type{}},
+		StringType{}, StringType{MaxLength: 4}, BytesType{},
+	}
+	for _, a := range typs {
+		for _, b := range typs {
+			if Same(a, b) != (FingerprintOf(a) == FingerprintOf(b)) {
+				t.Errorf("Same(%s, %s) disagrees with the fingerprints", a.Name(), b.Name())
+			}
+		}
+	}
+}
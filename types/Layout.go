@@ -0,0 +1,290 @@
+package types
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Layout Tells how the fields of a struct are placed in its payloads
+type Layout uint8
+
+const (
+	// PackedLayout places every field right after the previous one, the default
+	PackedLayout Layout = 0
+	// CLayout lays payloads out like a C compiler does on x86-64 and aarch64, which agree on it, so C programs can
+	// memcpy native structs: numbers are little-endian, each field is aligned to its alignment and structs, array
+	// elements and unions are padded to a multiple of their alignment, the largest of their fields or members. The
+	// layout applies to the fields and everything nested in them, which have to be fixed-size, made of primitives,
+	// structs, arrays and unions and have no layout of their own. Primitives are aligned to their size, so Char is
+	// laid out as char16_t and CChar as char. Padding is ignored when decoding and zero when encoding. A union does
+	// not tell which member it holds, its first member the payload is a valid value of, followed by zeros up to the
+	// size of its largest member, is assumed.
+	CLayout Layout = 1
+)
+
+// Structs with a layout other than PackedLayout are serialized with layoutStructTypeId: the length (4), the id, the
+// layout (1) and the struct serialized without it.
+
+// cCompatible Tells whether typ can be a field of a C layout struct: it has to be fixed-size and made of
+// primitives, structs without a layout, arrays and unions
+func cCompatible(typ Type) bool {
+	switch typ := typ.(type) {
+	case CharType, CCharType, Int32Type, Int64Type, Float32Type, Float64Type, BoolType:
+		return true
+	case StructType:
+		if typ.Layout != PackedLayout {
+			return false
+		}
+		for _, field := range typ.Fields {
+			if !cCompatible(field) {
+				return false
+			}
+		}
+		return true
+	case ArrayType:
+		return cCompatible(typ.Typ)
+	case UnionType:
+		for _, member := range typ.Members {
+			if !cCompatible(member) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// alignment Returns the alignment of typ as a field of a C layout struct
+func alignment(typ Type) uint64 {
+	align := uint64(1)
+	switch typ := typ.(type) {
+	case CharType, CCharType, Int32Type, Int64Type, Float32Type, Float64Type, BoolType:
+		return typ.Size()
+	case StructType:
+		for _, field := range typ.Fields {
+			align = maxUint(align, alignment(field))
+		}
+	case ArrayType:
+		return alignment(typ.Typ)
+	case UnionType:
+		for _, member := range typ.Members {
+			align = maxUint(align, alignment(member))
+		}
+	}
+	return align
+}
+
+// cSize Returns the size of typ in a C layout struct, ok is false if it overflows
+func cSize(typ Type) (size uint64, ok bool) {
+	switch typ := typ.(type) {
+	case StructType:
+		_, size, ok = typ.cLayout()
+		return size, ok
+	case ArrayType:
+		elemSize, ok := cSize(typ.Typ)
+		if !ok || (elemSize != 0 && typ.Length > math.MaxUint64/elemSize) {
+			return 0, false
+		}
+		return typ.Length * elemSize, true
+	case UnionType:
+		for _, member := range typ.Members {
+			memberSize, ok := cSize(member)
+			if !ok {
+				return 0, false
+			}
+			size = maxUint(size, memberSize)
+		}
+		return alignUp(size, alignment(typ))
+	}
+	return typ.Size(), true
+}
+
+// cLayout Returns the offsets of the fields of typ and its size when laid out like C, ok is false if the size
+// overflows
+func (typ StructType) cLayout() (offsets []uint64, size uint64, ok bool) {
+	offsets = make([]uint64, len(typ.Fields))
+	for i, field := range typ.Fields {
+		if size, ok = alignUp(size, alignment(field)); !ok {
+			return nil, 0, false
+		}
+		offsets[i] = size
+		fieldSize, ok := cSize(field)
+		if !ok || size+fieldSize < size {
+			return nil, 0, false
+		}
+		size += fieldSize
+	}
+	size, ok = alignUp(size, alignment(typ))
+	return offsets, size, ok
+}
+
+func alignUp(offset uint64, align uint64) (uint64, bool) {
+	aligned := (offset + align - 1) / align * align
+	return aligned, aligned >= offset
+}
+
+func maxUint(a uint64, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// packed Returns typ without its layout, whose payloads are what fromC converts payloads of typ to
+func (typ StructType) packed() StructType {
+	typ.Layout = PackedLayout
+	return typ
+}
+
+// fromC Converts data, the C layout payload of typ that data starts with, to the packed big-endian payload of typ
+func fromC(typ Type, data []byte, offset uint64) ([]byte, error) {
+	size, _ := cSize(typ)
+	if size > uint64(len(data)) {
+		return nil, valueError(offset, "%s needs %d bytes, %d left", typ.Name(), size, len(data))
+	}
+	switch typ := typ.(type) {
+	case StructType:
+		offsets, _, _ := typ.cLayout()
+		var packed []byte
+		for i, field := range typ.Fields {
+			converted, err := fromC(field, data[offsets[i]:], offset+offsets[i])
+			if err != nil {
+				return nil, err
+			}
+			packed = append(packed, converted...)
+		}
+		return packed, nil
+	case ArrayType:
+		if size == 0 {
+			return nil, nil // Nothing to convert, however many elements there are
+		}
+		stride := size / typ.Length
+		var packed []byte
+		for i := uint64(0); i < typ.Length; i++ {
+			converted, err := fromC(typ.Typ, data[i*stride:], offset+i*stride)
+			if err != nil {
+				return nil, err
+			}
+			packed = append(packed, converted...)
+		}
+		return packed, nil
+	case UnionType:
+		largest := uint64(0)
+		for _, member := range typ.Members {
+			memberSize, _ := cSize(member)
+			largest = maxUint(largest, memberSize)
+		}
+		for _, member := range typ.Members {
+			memberSize, _ := cSize(member)
+			if !allZero(data[memberSize:largest]) {
+				continue // The bytes after a member up to the largest one must be zero, the rest is padding
+			}
+			converted, err := fromC(member, data, offset)
+			if err == nil && Validate(member, converted) == nil {
+				return padTo(converted, typ.Size()), nil
+			}
+		}
+		return nil, valueError(offset, "payload does not fit any member of %s", typ.Name())
+	}
+	return reverse(data[:size]), nil
+}
+
+// toC Converts packed, the packed big-endian payload of typ, to the C layout payload of typ
+func toC(typ Type, packed []byte) ([]byte, error) {
+	size, _ := cSize(typ)
+	switch typ := typ.(type) {
+	case StructType:
+		offsets, _, _ := typ.cLayout()
+		spans, err := fieldSpans(typ.packed(), packed)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size)
+		for i, field := range typ.Fields {
+			converted, err := toC(field, packed[spans[i].start:spans[i].end])
+			if err != nil {
+				return nil, err
+			}
+			copy(data[offsets[i]:], converted)
+		}
+		return data, nil
+	case ArrayType:
+		if size == 0 {
+			return nil, nil
+		}
+		elemSize := typ.Typ.Size()
+		var data []byte
+		for i := uint64(0); i < typ.Length; i++ {
+			converted, err := toC(typ.Typ, packed[i*elemSize:(i+1)*elemSize])
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, converted...)
+		}
+		return data, nil
+	case UnionType:
+		for _, member := range typ.Members {
+			memberData := packed[:member.Size()]
+			if !allZero(packed[member.Size():]) || Validate(member, memberData) != nil {
+				continue
+			}
+			converted, err := toC(member, memberData)
+			if err != nil {
+				return nil, err
+			}
+			return padTo(converted, size), nil
+		}
+		return nil, valueError(0, "payload does not fit any member of %s", typ.Name())
+	}
+	return reverse(packed[:size]), nil
+}
+
+// reverse Swaps the byte order of a primitive
+func reverse(data []byte) []byte {
+	reversed := make([]byte, len(data))
+	for i, b := range data {
+		reversed[len(data)-1-i] = b
+	}
+	return reversed
+}
+
+func (typ StructType) serializeLaidOut() []byte {
+	inner := typ
+	inner.Layout = PackedLayout
+	ser := make([]byte, 6)
+	ser[4] = layoutStructTypeId
+	ser[5] = byte(typ.Layout)
+	ser = append(ser, inner.Serialize()...)
+	binary.BigEndian.PutUint32(ser[0:4], uint32(len(ser)))
+	return ser
+}
+
+// span Is where a field is in the payload of a struct
+type span struct {
+	start uint64
+	end   uint64
+}
+
+// fieldSpans Returns where each field of typ is in data, a payload of typ without a layout
+func fieldSpans(typ StructType, data []byte) ([]span, error) {
+	spans := make([]span, len(typ.Fields))
+	pos := uint64(0)
+	for i, field := range typ.Fields {
+		size, err := PayloadSize(field, data[pos:])
+		if err != nil {
+			return nil, err
+		}
+		spans[i] = span{start: pos, end: pos + size}
+		pos += size
+	}
+	return spans, nil
+}
+
+// assemble Concatenates the payloads of the fields of a struct without a layout
+func assemble(fields [][]byte) []byte {
+	var data []byte
+	for _, field := range fields {
+		data = append(data, field...)
+	}
+	return data
+}
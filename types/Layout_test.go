@@ -0,0 +1,116 @@
+package types
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestCLayout(t *testing.T) {
+	inner := StructType{Fields: []Type{Int32Type{}, BoolType{}}}
+	for _, c := range []struct {
+		typ     StructType
+		offsets []uint64
+		size    uint64
+	}{
+		{StructType{Fields: []Type{CharType{}, Int64Type{}, BoolType{}}, Layout: CLayout}, []uint64{0, 8, 16}, 24},
+		{StructType{Fields: []Type{CCharType{}, CharType{}, CCharType{}}, Layout: CLayout}, []uint64{0, 2, 4}, 6},
+		{StructType{Fields: []Type{BoolType{}, inner}, Layout: CLayout}, []uint64{0, 4}, 12},
+		{StructType{Fields: []Type{BoolType{}, ArrayType{Length: 3, Typ: Float64Type{}}}, Layout: CLayout},
+			[]uint64{0, 8}, 32},
+		{StructType{Fields: []Type{BoolType{}, ArrayType{Length: 2, Typ: inner}}, Layout: CLayout}, []uint64{0, 4}, 20},
+		{StructType{Fields: []Type{BoolType{}, UnionType{Members: []Type{CharType{}, Float32Type{}}}}, Layout: CLayout},
+			[]uint64{0, 4}, 8},
+		{StructType{Fields: []Type{BoolType{}, UnionType{Members: []Type{Int64Type{}, ArrayType{Length: 9, Typ: CCharType{}}}},
+			BoolType{}}, Layout: CLayout}, []uint64{0, 8, 24}, 32},
+		{StructType{Layout: CLayout}, []uint64{}, 0},
+	} {
+		offsets, size, ok := c.typ.cLayout()
+		if !ok || !reflect.DeepEqual(offsets, c.offsets) || size != c.size || c.typ.Size() != c.size {
+			t.Errorf("%s: expected offsets %v and size %d, got %v and %d", c.typ.Name(), c.offsets, c.size, offsets,
+				size)
+		}
+		deserialized, err := Deserialize(c.typ.Serialize())
+		if err != nil || !Same(deserialized, c.typ) || deserialized.(StructType).Layout != CLayout {
+			t.Errorf("%s: round trip failed: %v", c.typ.Name(), err)
+		}
+	}
+	if Same(StructType{Fields: inner.Fields, Layout: CLayout}, inner) {
+		t.Error("The layout is part of a type's identity")
+	}
+}
+
+func TestCLayoutDecodeRejects(t *testing.T) {
+	withString := StructType{Fields: []Type{StringType{}}, Layout: CLayout}.Serialize()
+	laidOut := StructType{Fields: []Type{Int32Type{}}, Layout: CLayout}
+	nested := StructType{Fields: []Type{laidOut}, Layout: CLayout}.Serialize()
+	unknownLayout := laidOut.Serialize()
+	unknownLayout[5] = 7
+	for _, raw := range [][]byte{withString, nested, unknownLayout} {
+		if _, err := Deserialize(raw); err == nil {
+			t.Errorf("%v should be rejected", raw)
+		}
+	}
+}
+
+func TestCLayoutPayloads(t *testing.T) {
+	typ := StructType{Fields: []Type{BoolType{}, Int32Type{}, CharType{}}, Layout: CLayout}
+	payload := []byte{1, 0xAA, 0xAA, 0xAA, 5, 0, 0, 0, 'c', 0, 0xAA, 0xAA} // Padding as memcpy leaves it
+	value, err := Decode(typ, payload)
+	if err != nil || !reflect.DeepEqual(value, []interface{}{true, int32(5), 'c'}) {
+		t.Fatalf("Wrong value %v %v", value, err)
+	}
+	encoded, err := Encode(typ, value)
+	if err != nil || !bytes.Equal(encoded, []byte{1, 0, 0, 0, 5, 0, 0, 0, 'c', 0, 0, 0}) {
+		t.Errorf("Expected little-endian numbers and zero padding, got %v %v", encoded, err)
+	}
+
+	packed := StructType{Fields: []Type{BoolType{}, Int32Type{}}}
+	trimmed, err := Trim(typ, packed, payload)
+	if err != nil || !bytes.Equal(trimmed, []byte{1, 0, 0, 0, 5}) {
+		t.Errorf("Wrong projection to packed %v %v", trimmed, err)
+	}
+	cPrefix := StructType{Fields: []Type{BoolType{}, Int32Type{}}, Layout: CLayout}
+	laidOut, err := Trim(StructType{Fields: []Type{BoolType{}, Int32Type{}, BoolType{}}}, cPrefix, []byte{1, 0, 0, 0, 5, 0})
+	if err != nil || !bytes.Equal(laidOut, []byte{1, 0, 0, 0, 5, 0, 0, 0}) {
+		t.Errorf("Wrong projection to C layout %v %v", laidOut, err)
+	}
+
+	defaults, err := CreateDefaults(typ, []byte{0, 0, 0, 0, 0, 0, 0, 0, 'd', 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	extended, err := defaults.Extend(packed, []byte{1, 0, 0, 0, 5}, false)
+	if err != nil || !bytes.Equal(extended, []byte{1, 0, 0, 0, 5, 0, 0, 0, 'd', 0, 0, 0}) {
+		t.Errorf("Wrong extension %v %v", extended, err)
+	}
+}
+
+func TestCLayoutNested(t *testing.T) {
+	point := StructType{Fields: []Type{CCharType{}, Int32Type{}}}
+	union := UnionType{Members: []Type{Int64Type{}, ArrayType{Length: 9, Typ: CCharType{}}}}
+	typ := StructType{Fields: []Type{BoolType{}, point, union}, Layout: CLayout}
+	payload := []byte{
+		1, 0, 0, 0, // Bool and the padding aligning point
+		'p', 0, 0, 0, 7, 0, 0, 0, // point
+		0, 0, 0, 0, // Padding aligning the union
+		'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 0, 0, 0, 0, 0, 0, 0, // The union padded to 16
+	}
+	chars := []interface{}{byte('a'), byte('b'), byte('c'), byte('d'), byte('e'), byte('f'), byte('g'), byte('h'),
+		byte('i')}
+	expected := []interface{}{true, []interface{}{byte('p'), int32(7)}, UnionValue{Member: 1, Value: chars}}
+	value, err := Decode(typ, payload)
+	if err != nil || !reflect.DeepEqual(value, expected) {
+		t.Fatalf("Wrong value %v %v", value, err)
+	}
+	encoded, err := Encode(typ, expected)
+	if err != nil || !bytes.Equal(encoded, payload) {
+		t.Errorf("Expected %v, got %v %v", payload, encoded, err)
+	}
+
+	payload[16+8] = 0 // Only the int64 is left
+	value, err = Decode(typ, payload)
+	if err != nil || !reflect.DeepEqual(value.([]interface{})[2], UnionValue{Member: 0, Value: int64(0x6867666564636261)}) {
+		t.Errorf("Expected the int64 member, got %v %v", value, err)
+	}
+}
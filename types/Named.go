@@ -0,0 +1,148 @@
+package types
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Structs may name their fields by setting StructType.Names, one name per field. Named structs are serialized with
+// namedStructTypeId: the length (4), the id, the number of fields (4) and per field the length of its name (1), the
+// name and the field's type. Receivers of a named struct get the fields of the same names from any named struct,
+// wherever they are in it.
+
+// MaxNameLength bounds the length in bytes of a field name
+const MaxNameLength = 255
+
+// CreateNamedStructType Creates a struct naming its fields, checking the names like CheckNames
+func CreateNamedStructType(fields []Type, names []string) (StructType, error) {
+	typ := StructType{Fields: fields, Names: names}
+	if names == nil {
+		typ.Names = []string{}
+	}
+	return typ, CheckNames(typ)
+}
+
+// CheckNames Checks that every named struct in typ has a name per field, each valid UTF-8 of 1 to MaxNameLength
+// bytes and unique. Other structs cannot be serialized faithfully.
+func CheckNames(typ Type) error {
+	switch typ := typ.(type) {
+	case StructType:
+		if typ.named() {
+			if len(typ.Names) != len(typ.Fields) {
+				return fmt.Errorf("%d names for %d fields", len(typ.Names), len(typ.Fields))
+			}
+			for i, name := range typ.Names {
+				if len(name) == 0 || len(name) > MaxNameLength || !utf8.ValidString(name) {
+					return fmt.Errorf("name of field %d is empty, longer than %d bytes or not UTF-8", i, MaxNameLength)
+				}
+				if typ.fieldIndex(name) != i {
+					return fmt.Errorf("duplicate field name %q", name)
+				}
+			}
+		}
+		return checkAllNames(typ.Fields)
+	case UnionType:
+		return checkAllNames(typ.Members)
+	case TaggedUnionType:
+		return checkAllNames(typ.Members)
+	case ArrayType:
+		return CheckNames(typ.Typ)
+	case ListType:
+		return CheckNames(typ.Typ)
+	}
+	return nil
+}
+
+func checkAllNames(typs []Type) error {
+	for _, typ := range typs {
+		if err := CheckNames(typ); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (typ StructType) named() bool {
+	return typ.Names != nil
+}
+
+// nameOf Returns the name of field i, empty if it has none
+func (typ StructType) nameOf(i int) string {
+	if i < len(typ.Names) {
+		return typ.Names[i]
+	}
+	return ""
+}
+
+// fieldIndex Returns the index of the field called name, or -1
+func (typ StructType) fieldIndex(name string) int {
+	for i, fieldName := range typ.Names {
+		if fieldName == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (typ StructType) serializeNamed() []byte {
+	ser := make([]byte, 9)
+	ser[4] = namedStructTypeId
+	binary.BigEndian.PutUint32(ser[5:9], uint32(len(typ.Fields)))
+	for i, field := range typ.Fields {
+		name := typ.nameOf(i)
+		if len(name) > MaxNameLength {
+			name = name[:MaxNameLength] // Not faithful, but the length has to fit, see CheckNames
+		}
+		ser = append(ser, byte(len(name)))
+		ser = append(append(ser, name...), field.Serialize()...)
+	}
+	binary.BigEndian.PutUint32(ser[0:4], uint32(len(ser)))
+	return ser
+}
+
+// decodeNamedFields Decodes the names and fields of the named struct at offset
+func decodeNamedFields(raw []byte, offset int, end int, depth int) ([]string, []Type, error) {
+	if depth >= MaxDepth {
+		return nil, nil, decodeError(offset, "nested deeper than %d", MaxDepth)
+	}
+	if end-offset < 9 {
+		return nil, nil, decodeError(offset, "named struct needs 9 bytes, has %d", end-offset)
+	}
+	noFields := binary.BigEndian.Uint32(raw[offset+5 : offset+9])
+	if noFields > MaxFields {
+		return nil, nil, decodeError(offset+5, "%d fields exceed the maximum of %d", noFields, MaxFields)
+	}
+	names := []string{}
+	var fields []Type
+	pos := offset + 9
+	for i := uint32(0); i < noFields; i++ {
+		if pos >= end {
+			return nil, nil, decodeError(pos, "missing the name of field %d", i)
+		}
+		nameLen := int(raw[pos])
+		if nameLen == 0 || nameLen > end-pos-1 {
+			return nil, nil, decodeError(pos, "name of field %d has invalid length %d", i, nameLen)
+		}
+		name := string(raw[pos+1 : pos+1+nameLen])
+		if !utf8.ValidString(name) {
+			return nil, nil, decodeError(pos+1, "name of field %d is not valid UTF-8", i)
+		}
+		for _, other := range names {
+			if other == name {
+				return nil, nil, decodeError(pos+1, "duplicate field name %q", name)
+			}
+		}
+		field, fieldEnd, err := decode(raw, pos+1+nameLen, end, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		names = append(names, name)
+		fields = append(fields, field)
+		pos = fieldEnd
+	}
+	if pos != end {
+		return nil, nil, decodeError(pos, "%d bytes after the last field", end-pos)
+	}
+	return names, fields, nil
+}
@@ -0,0 +1,83 @@
+package types
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestNamedStructSerialize(t *testing.T) {
+	typ := StructType{Fields: []Type{Int32Type{}, StringType{}}, Names: []string{"id", "label"}}
+	deserialized, err := Deserialize(typ.Serialize())
+	if err != nil || !reflect.DeepEqual(deserialized, typ) {
+		t.Fatalf("Round trip failed: %v %v", deserialized, err)
+	}
+	if typ.Name() != "Struct-id:Int32-label:String" {
+		t.Errorf("Wrong name %s", typ.Name())
+	}
+	positional := StructType{Fields: typ.Fields}
+	renamed := StructType{Fields: typ.Fields, Names: []string{"id", "text"}}
+	if Same(typ, positional) || Same(typ, renamed) {
+		t.Error("Field names are part of a type's identity")
+	}
+
+	duplicate := StructType{Fields: []Type{Int32Type{}, Int32Type{}}, Names: []string{"x", "x"}}.Serialize()
+	unnamed := StructType{Fields: []Type{Int32Type{}}, Names: []string{""}}.Serialize()
+	for _, raw := range [][]byte{duplicate, unnamed, typ.Serialize()[:12]} {
+		if _, err := Deserialize(raw); err == nil {
+			t.Errorf("%v should be rejected", raw)
+		}
+	}
+}
+
+func TestCheckNames(t *testing.T) {
+	if _, err := CreateNamedStructType([]Type{Int32Type{}, BoolType{}}, []string{"id", "ok"}); err != nil {
+		t.Errorf("Expected valid names to be accepted, got %v", err)
+	}
+	long := string(bytes.Repeat([]byte{'a'}, MaxNameLength+1))
+	for _, names := range [][]string{{"id"}, {"id", "id"}, {"id", ""}, {"id", long}, {"id", "\xff"}, nil} {
+		if _, err := CreateNamedStructType([]Type{Int32Type{}, BoolType{}}, names); err == nil {
+			t.Errorf("Expected names %q to be rejected", names)
+		}
+	}
+
+	mismatched := StructType{Fields: []Type{Int32Type{}, BoolType{}}, Names: []string{"id"}}
+	nested := ListType{Typ: ArrayType{Length: 2, Typ: mismatched}}
+	if err := CheckNames(nested); err == nil {
+		t.Error("Expected names of nested structs to be checked")
+	}
+	if _, err := Deserialize(nested.Serialize()); err == nil {
+		t.Error("Expected a struct with missing names not to serialize faithfully")
+	}
+	if _, err := Deserialize(StructType{Fields: []Type{Int32Type{}}, Names: []string{long}}.Serialize()); err != nil {
+		t.Errorf("Expected an overlong name to be cut to fit, got %v", err)
+	}
+}
+
+func TestNamedProjection(t *testing.T) {
+	xyz := StructType{Fields: []Type{Int32Type{}, CharType{}, Int32Type{}}, Names: []string{"x", "y", "z"}}
+	zx := StructType{Fields: []Type{Int32Type{}, Int32Type{}}, Names: []string{"z", "x"}}
+	if !IsSubtype(xyz, zx) || IsSubtype(zx, xyz) {
+		t.Error("Named fields should match by name")
+	}
+	if IsSubtype(StructType{Fields: xyz.Fields}, zx) {
+		t.Error("Positional structs have no names to match")
+	}
+	projected, err := Trim(xyz, zx, []byte{0, 0, 0, 1, 0, 'a', 0, 0, 0, 3})
+	if err != nil || !bytes.Equal(projected, []byte{0, 0, 0, 3, 0, 0, 0, 1}) {
+		t.Errorf("Wrong projection %v %v", projected, err)
+	}
+
+	defaults, err := CreateDefaults(xyz, []byte{0, 0, 0, 0, 0, '?', 0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	y := StructType{Fields: []Type{CharType{}}, Names: []string{"y"}}
+	extended, err := defaults.Extend(y, []byte{0, 'b'}, false)
+	if err != nil || !bytes.Equal(extended, []byte{0, 0, 0, 0, 0, 'b', 0, 0, 0, 0}) {
+		t.Errorf("Wrong extension %v %v", extended, err)
+	}
+	if defaults.CanExtend(xyz, false) {
+		t.Error("Nothing to extend when no field is missing")
+	}
+}
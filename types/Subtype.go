@@ -0,0 +1,323 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// IsSubtype Tells whether payloads of typ can be projected to payloads of superType. Every type is a subtype of
+// itself. A struct is a subtype of a struct whose fields are super types of a prefix of its fields or, if the super
+// type names its fields, of its fields of the same names wherever they are. The struct without fields is only a
+// super type of itself, so accepting it does not mean receiving every struct. Arrays and lists
+// are subtypes of arrays and lists of super types of their elements. A union is a subtype of a union with a
+// superset of its members and a type is a subtype of a union with a member it is a subtype of.
+func IsSubtype(typ Type, superType Type) bool {
+	return isSubtype(typ, superType, false)
+}
+
+// IsWideningSubtype Tells whether typ is a subtype of superType when numbers may also be widened without loss:
+// Int32 to Int64 or Float64, Float32 to Float64. Receivers opt into widening.
+func IsWideningSubtype(typ Type, superType Type) bool {
+	return isSubtype(typ, superType, true)
+}
+
+func isSubtype(typ Type, superType Type, widen bool) bool {
+	if Same(typ, superType) {
+		return true
+	}
+	switch superType := superType.(type) {
+	case Int64Type:
+		_, isInt32 := typ.(Int32Type)
+		return widen && isInt32
+	case Float64Type:
+		switch typ.(type) {
+		case Int32Type, Float32Type:
+			return widen
+		}
+		return false
+	case StructType:
+		structType, isStruct := typ.(StructType)
+		if !isStruct || len(superType.Fields) == 0 {
+			return false // Empty structs are the same type, checked above
+		}
+		if superType.named() {
+			return namedSubtype(structType, superType, widen)
+		}
+		if len(superType.Fields) > len(structType.Fields) {
+			return false
+		}
+		for i, superField := range superType.Fields {
+			if !isSubtype(structType.Fields[i], superField, widen) {
+				return false
+			}
+		}
+		return true
+	case ArrayType:
+		arrayType, isArray := typ.(ArrayType)
+		return isArray && arrayType.Length == superType.Length && isSubtype(arrayType.Typ, superType.Typ, widen)
+	case ListType:
+		listType, isList := typ.(ListType)
+		bounded := superType.MaxLength == 0 || (listType.MaxLength != 0 && listType.MaxLength <= superType.MaxLength)
+		return isList && bounded && isSubtype(listType.Typ, superType.Typ, widen)
+	case UnionType:
+		if unionType, isUnion := typ.(UnionType); isUnion {
+			return memberSubset(unionType.Members, superType.Members)
+		}
+		return closestSuperType(typ, superType.Members, widen) >= 0
+	case TaggedUnionType:
+		if closestSuperType(typ, superType.Members, widen) >= 0 {
+			return true
+		}
+		unionType, isUnion := typ.(TaggedUnionType)
+		if !isUnion {
+			return false
+		}
+		for _, member := range unionType.Members {
+			if closestSuperType(member, superType.Members, widen) < 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// namedSubtype Tells whether typ has a field of every name of superType, each a subtype of the field of superType
+func namedSubtype(typ StructType, superType StructType, widen bool) bool {
+	for i, name := range superType.Names {
+		index := typ.fieldIndex(name)
+		if index < 0 || !isSubtype(typ.Fields[index], superType.Fields[i], widen) {
+			return false
+		}
+	}
+	return true
+}
+
+// memberSubset Tells whether every member is also one of superMembers. Untagged union payloads do not tell which
+// member they hold, so members cannot be projected and have to be the same.
+func memberSubset(members []Type, superMembers []Type) bool {
+	for _, member := range members {
+		found := false
+		for _, superMember := range superMembers {
+			found = found || Same(member, superMember)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// ClosestSuperType Returns the index of the candidate that is the most specific super type of typ, the first one
+// among unrelated ones, or -1 if none is a super type
+func ClosestSuperType(typ Type, candidates []Type) int {
+	return closestSuperType(typ, candidates, false)
+}
+
+// ClosestWideningSuperType Is ClosestSuperType for IsWideningSubtype
+func ClosestWideningSuperType(typ Type, candidates []Type) int {
+	return closestSuperType(typ, candidates, true)
+}
+
+func closestSuperType(typ Type, candidates []Type, widen bool) int {
+	closest := -1
+	for i, candidate := range candidates {
+		if !isSubtype(typ, candidate, widen) {
+			continue
+		}
+		if closest < 0 || (isSubtype(candidate, candidates[closest], widen) && !Same(candidate, candidates[closest])) {
+			closest = i
+		}
+	}
+	return closest
+}
+
+// EachSuperType Enumerates typ and its super types, starting with typ itself, until yield returns false. Every type
+// comes before its super types. A struct has a super type for every non-empty prefix of its fields combined with
+// every super type of those fields, exponentially many, so they are produced as needed. The other subsets of the
+// fields of a named struct are not enumerated. Unions have a super type for every superset of their members, which
+// is not enumerated: use IsSubtype or ClosestSuperType to look for them.
+func EachSuperType(typ Type, yield func(Type) bool) {
+	eachSuperType(typ, yield)
+}
+
+// SuperTypesEnumerable Tells whether EachSuperType enumerates every super type of typ. It does not if typ holds a
+// union, a list, a named or laid out struct, whose super types are not all enumerated.
+func SuperTypesEnumerable(typ Type) bool {
+	switch typ := typ.(type) {
+	case StructType:
+		if typ.named() || typ.Layout != PackedLayout {
+			return false
+		}
+		for _, field := range typ.Fields {
+			if !SuperTypesEnumerable(field) {
+				return false
+			}
+		}
+		return true
+	case ArrayType:
+		return SuperTypesEnumerable(typ.Typ)
+	case UnionType, TaggedUnionType, ListType:
+		return false
+	}
+	return true
+}
+
+// superTypesOf Collects what EachSuperType enumerates, for GetSuperTypes
+func superTypesOf(typ Type) []Type {
+	var superTypes []Type
+	EachSuperType(typ, func(superType Type) bool {
+		superTypes = append(superTypes, superType)
+		return true
+	})
+	return superTypes
+}
+
+// eachSuperType Returns false once yield stopped the enumeration
+func eachSuperType(typ Type, yield func(Type) bool) bool {
+	switch typ := typ.(type) {
+	case StructType:
+		shortest := 1 // The struct without fields is only a super type of itself
+		if len(typ.Fields) == 0 {
+			shortest = 0
+		}
+		for n := len(typ.Fields); n >= shortest; n-- {
+			var names []string
+			if typ.named() {
+				names = typ.Names[:n]
+			}
+			prefix := make([]Type, 0, n)
+			if !eachFieldCombination(typ.Fields[:n], prefix, func(fields []Type) bool {
+				return yield(StructType{Fields: fields, Names: names, Layout: typ.Layout})
+			}) {
+				return false
+			}
+		}
+		return true
+	case ArrayType:
+		return eachSuperType(typ.Typ, func(elemTyp Type) bool {
+			return yield(ArrayType{Length: typ.Length, Typ: elemTyp})
+		})
+	case ListType:
+		return eachSuperType(typ.Typ, func(elemTyp Type) bool {
+			return yield(ListType{MaxLength: typ.MaxLength, Typ: elemTyp})
+		})
+	}
+	return yield(typ)
+}
+
+// eachFieldCombination Yields every choice of super types for the fields following chosen
+func eachFieldCombination(fields []Type, chosen []Type, yield func([]Type) bool) bool {
+	if len(chosen) == len(fields) {
+		return yield(append([]Type(nil), chosen...))
+	}
+	return eachSuperType(fields[len(chosen)], func(field Type) bool {
+		return eachFieldCombination(fields, append(chosen, field), yield)
+	})
+}
+
+// project Projects data, exactly one payload of typ, to a payload of superType, typ being a subtype of superType
+func project(typ Type, superType Type, data []byte, widen bool) ([]byte, error) {
+	if Same(typ, superType) {
+		return data, nil
+	}
+	if structType, isStruct := typ.(StructType); isStruct && structType.Layout == CLayout {
+		packed, err := fromC(structType, data, 0)
+		if err != nil {
+			return nil, err
+		}
+		return project(structType.packed(), superType, packed, widen)
+	}
+	if superStruct, isStruct := superType.(StructType); isStruct && superStruct.Layout == CLayout {
+		projected, err := project(typ, superStruct.packed(), data, widen)
+		if err != nil {
+			return nil, err
+		}
+		return toC(superStruct, projected)
+	}
+	switch superType := superType.(type) {
+	case Int64Type:
+		return appendUint(nil, uint64(int32(binary.BigEndian.Uint32(data))), 8), nil
+	case Float64Type:
+		value := float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+		if _, isInt32 := typ.(Int32Type); isInt32 {
+			value = float64(int32(binary.BigEndian.Uint32(data)))
+		}
+		return appendUint(nil, math.Float64bits(value), 8), nil
+	case StructType:
+		structType := typ.(StructType)
+		spans, err := fieldSpans(structType, data)
+		if err != nil {
+			return nil, err
+		}
+		fields := make([][]byte, len(superType.Fields))
+		for i, superField := range superType.Fields {
+			index := i
+			if superType.named() {
+				index = structType.fieldIndex(superType.Names[i])
+			}
+			field := data[spans[index].start:spans[index].end]
+			if fields[i], err = project(structType.Fields[index], superField, field, widen); err != nil {
+				return nil, err
+			}
+		}
+		return assemble(fields), nil
+	case ArrayType:
+		return projectElements(typ.(ArrayType).Typ, superType.Typ, superType.Length, data, nil, widen)
+	case ListType:
+		count := uint64(binary.BigEndian.Uint32(data[0:4]))
+		prefix := append([]byte{}, data[0:4]...)
+		return projectElements(typ.(ListType).Typ, superType.Typ, count, data[4:], prefix, widen)
+	case UnionType:
+		if _, isUnion := typ.(UnionType); isUnion {
+			return padTo(data, superType.Size()), nil
+		}
+		member := superType.Members[closestSuperType(typ, superType.Members, widen)]
+		projected, err := project(typ, member, data, widen)
+		if err != nil {
+			return nil, err
+		}
+		return padTo(projected, superType.Size()), nil
+	case TaggedUnionType:
+		if index := closestSuperType(typ, superType.Members, widen); index >= 0 {
+			projected, err := project(typ, superType.Members[index], data, widen)
+			if err != nil {
+				return nil, err
+			}
+			return append(appendUint(nil, uint64(index), 4), projected...), nil
+		}
+		member := typ.(TaggedUnionType).Members[binary.BigEndian.Uint32(data[0:4])]
+		return project(member, superType, data[4:], widen)
+	}
+	return nil, errors.New("not a subtype")
+}
+
+func projectElements(elemTyp Type, superElemTyp Type, count uint64, data []byte, projected []byte,
+	widen bool) ([]byte, error) {
+	if FixedSize(superElemTyp) && superElemTyp.Size() == 0 {
+		return projected, nil // Nothing is left of the elements
+	}
+	if elemTyp.Size() == 0 && count > MaxFields {
+		return nil, fmt.Errorf("%d elements of size 0", count) // Would loop and allocate without bound
+	}
+	pos := uint64(0)
+	for i := uint64(0); i < count; i++ {
+		size, err := PayloadSize(elemTyp, data[pos:])
+		if err != nil {
+			return nil, err
+		}
+		elem, err := project(elemTyp, superElemTyp, data[pos:pos+size], widen)
+		if err != nil {
+			return nil, err
+		}
+		projected = append(projected, elem...)
+		pos += size
+	}
+	return projected, nil
+}
+
+func padTo(data []byte, size uint64) []byte {
+	return append(append([]byte{}, data...), make([]byte, size-uint64(len(data)))...)
+}
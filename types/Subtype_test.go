@@ -0,0 +1,166 @@
+package types
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestIsSubtype(t *testing.T) {
+	point := StructType{Fields: []Type{Int32Type{}, Int32Type{}}}
+	point3D := StructType{Fields: []Type{Int32Type{}, Int32Type{}, Int32Type{}}}
+	for _, c := range []struct {
+		typ, superType Type
+		isSubtype      bool
+	}{
+		{point3D, point, true},
+		{point, point3D, false},
+		{StructType{Fields: []Type{point3D, BoolType{}}}, StructType{Fields: []Type{point}}, true},
+		{StructType{Fields: []Type{point, BoolType{}}}, StructType{Fields: []Type{point3D}}, false},
+		{ArrayType{Length: 2, Typ: point3D}, ArrayType{Length: 2, Typ: point}, true},
+		{ArrayType{Length: 3, Typ: point3D}, ArrayType{Length: 2, Typ: point}, false},
+		{ListType{MaxLength: 4, Typ: point3D}, ListType{Typ: point}, true},
+		{ListType{Typ: point3D}, ListType{MaxLength: 4, Typ: point}, false},
+		{UnionType{Members: []Type{Int32Type{}}}, UnionType{Members: []Type{Int64Type{}, Int32Type{}}}, true},
+		{UnionType{Members: []Type{Int64Type{}, Int32Type{}}}, UnionType{Members: []Type{Int32Type{}}}, false},
+		{UnionType{Members: []Type{point3D}}, UnionType{Members: []Type{point}}, false},
+		{point3D, UnionType{Members: []Type{Int64Type{}, point}}, true},
+		{TaggedUnionType{Members: []Type{point3D}}, TaggedUnionType{Members: []Type{CharType{}, point}}, true},
+		{Int32Type{}, Int64Type{}, false},
+	} {
+		if IsSubtype(c.typ, c.superType) != c.isSubtype {
+			t.Errorf("IsSubtype(%s, %s) should be %v", c.typ.Name(), c.superType.Name(), c.isSubtype)
+		}
+	}
+}
+
+func TestClosestSuperType(t *testing.T) {
+	point3D := StructType{Fields: []Type{Int32Type{}, Int32Type{}, Int32Type{}}}
+	candidates := []Type{
+		Int32Type{},
+		StructType{Fields: []Type{Int32Type{}}},
+		StructType{Fields: []Type{Int32Type{}, Int32Type{}}},
+		StructType{},
+	}
+	if closest := ClosestSuperType(point3D, candidates); closest != 2 {
+		t.Errorf("Expected the longest prefix, got %d", closest)
+	}
+	if closest := ClosestSuperType(Int64Type{}, candidates); closest != -1 {
+		t.Errorf("Expected no super type, got %d", closest)
+	}
+}
+
+func TestEachSuperType(t *testing.T) {
+	inner := StructType{Fields: []Type{Int32Type{}, CharType{}}}
+	typ := StructType{Fields: []Type{inner, BoolType{}}}
+	var superTypes []Type
+	EachSuperType(typ, func(superType Type) bool {
+		superTypes = append(superTypes, superType)
+		return true
+	})
+	// Both fields, with the 2 super types of inner, then inner's 2 alone. The empty struct is not a super type.
+	if len(superTypes) != 4 || !Same(superTypes[0], typ) || !Same(superTypes[3], StructType{Fields: []Type{
+		StructType{Fields: []Type{Int32Type{}}}}}) {
+		t.Errorf("Wrong super types %v", superTypes)
+	}
+	if IsSubtype(typ, StructType{}) || !IsSubtype(StructType{}, StructType{}) {
+		t.Error("The empty struct should only be a super type of itself")
+	}
+	if !reflect.DeepEqual(typ.GetSuperTypes(), superTypes) {
+		t.Error("GetSuperTypes should collect the enumeration")
+	}
+	for i, superType := range superTypes {
+		if !IsSubtype(typ, superType) {
+			t.Errorf("%s is not a super type", superType.Name())
+		}
+		for _, other := range superTypes[:i] {
+			if Same(other, superType) {
+				t.Errorf("%s enumerated twice", superType.Name())
+			}
+		}
+	}
+
+	wide := StructType{}
+	for i := 0; i < 64; i++ {
+		wide.Fields = append(wide.Fields, inner)
+	}
+	count := 0
+	EachSuperType(wide, func(Type) bool { // 3^64 super types, only produced on demand
+		count++
+		return count < 10
+	})
+	if count != 10 {
+		t.Errorf("Enumeration should stop when asked, got %d", count)
+	}
+}
+
+func TestTrimNested(t *testing.T) {
+	point := StructType{Fields: []Type{Int32Type{}, Int32Type{}}}
+	point3D := StructType{Fields: []Type{Int32Type{}, Int32Type{}, Int32Type{}}}
+	typ := StructType{Fields: []Type{ListType{Typ: point3D}, StringType{}, BoolType{}}}
+	superType := StructType{Fields: []Type{ListType{Typ: point}, StringType{}}}
+	payload := []byte{
+		0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0, 4, 0, 0, 0, 5, 0, 0, 0, 6,
+		0, 0, 0, 1, 'x',
+		1,
+	}
+	trimmed, err := Trim(typ, superType, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 4, 0, 0, 0, 5, 0, 0, 0, 1, 'x'}
+	if !bytes.Equal(trimmed, expected) {
+		t.Errorf("Expected %v, got %v", expected, trimmed)
+	}
+
+	union := UnionType{Members: []Type{Int64Type{}, point}}
+	padded, err := Trim(point3D, union, []byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3})
+	if err != nil || !bytes.Equal(padded, []byte{0, 0, 0, 1, 0, 0, 0, 2}) {
+		t.Errorf("Wrong union projection %v %v", padded, err)
+	}
+	retagged, err := Trim(TaggedUnionType{Members: []Type{point3D}}, TaggedUnionType{Members: []Type{CharType{}, point}},
+		[]byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3})
+	if err != nil || !bytes.Equal(retagged, []byte{0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 2}) {
+		t.Errorf("Wrong tagged union projection %v %v", retagged, err)
+	}
+	if _, err := Trim(point, point3D, []byte{0, 0, 0, 1, 0, 0, 0, 2}); err == nil {
+		t.Error("Trimming to a subtype should fail")
+	}
+}
+
+func TestProjectZeroSizeElements(t *testing.T) {
+	empty := StructType{Fields: []Type{StructType{}}}
+	typ := ArrayType{Length: 1 << 60, Typ: StructType{Fields: []Type{StructType{}, StructType{}}}}
+	superType := ArrayType{Length: 1 << 60, Typ: empty}
+	if trimmed, err := Trim(typ, superType, nil); err != nil || len(trimmed) != 0 {
+		t.Errorf("Expected an empty payload, got %v %v", trimmed, err)
+	}
+	union := ArrayType{Length: 1 << 60, Typ: UnionType{Members: []Type{empty, BoolType{}}}}
+	if _, err := Trim(superType, union, nil); err == nil {
+		t.Error("Projection growing zero-size elements should be refused")
+	}
+}
+
+func TestWidening(t *testing.T) {
+	typ := StructType{Fields: []Type{Int32Type{}, ArrayType{Length: 2, Typ: Float32Type{}}, Int32Type{}}}
+	wide := StructType{Fields: []Type{Int64Type{}, ArrayType{Length: 2, Typ: Float64Type{}}, Float64Type{}}}
+	if IsSubtype(typ, wide) || !IsWideningSubtype(typ, wide) || IsWideningSubtype(wide, typ) {
+		t.Error("Widening must be opt-in and one way")
+	}
+	payload, _ := Encode(typ, []interface{}{int32(-3), []interface{}{float32(0.5), float32(-2)}, int32(1 << 30)})
+	widened, err := TrimWidening(typ, wide, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := Decode(wide, widened)
+	expected := []interface{}{int64(-3), []interface{}{0.5, -2.0}, float64(1 << 30)}
+	if err != nil || !reflect.DeepEqual(value, expected) {
+		t.Errorf("Expected %v, got %v (%v)", expected, value, err)
+	}
+	if _, err := Trim(typ, wide, payload); err == nil {
+		t.Error("Trim must not widen")
+	}
+	if IsWideningSubtype(Int64Type{}, Float64Type{}) || IsWideningSubtype(Float64Type{}, Float32Type{}) {
+		t.Error("Lossy conversions must not be allowed")
+	}
+}
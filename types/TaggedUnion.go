@@ -0,0 +1,80 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// TaggedUnionType holds a value of one of its members. Its payload is the index of the member (4) followed by the
+// member's payload, so it is variable-size unless all members have the same fixed size. Unlike UnionType, members
+// may be variable-size.
+type TaggedUnionType struct {
+	Type
+	Members []Type
+}
+
+func (typ TaggedUnionType) Name() string {
+	name := "TaggedUnion"
+	for _, memberTyp := range typ.Members {
+		name += "-" + memberTyp.Name()
+	}
+	return name
+}
+func (typ TaggedUnionType) typId() byte {
+	return taggedUnionTypeId
+}
+
+// Size Returns the size of the smallest payload, the tag and the smallest member
+func (typ TaggedUnionType) Size() uint64 {
+	size := uint64(0)
+	for i, memberTyp := range typ.Members {
+		if i == 0 || memberTyp.Size() < size {
+			size = memberTyp.Size()
+		}
+	}
+	return 4 + size
+}
+func (typ TaggedUnionType) GetSuperTypes() []Type { return superTypesOf(typ) }
+func (typ TaggedUnionType) Serialize() []byte {
+	ser := UnionType{Members: typ.Members}.Serialize() // Same layout, different id
+	ser[4] = typ.typId()
+	return ser
+}
+func (typ TaggedUnionType) Deserialize(data []byte) (Type, error) {
+	return deserializeAs(taggedUnionTypeId, data)
+}
+
+func (typ TaggedUnionType) fixedSize() bool {
+	for _, member := range typ.Members {
+		if !FixedSize(member) || member.Size() != typ.Members[0].Size() {
+			return false
+		}
+	}
+	return true
+}
+
+// member Returns the member tagged in data, which must hold at least the tag
+func (typ TaggedUnionType) member(data []byte, offset uint64) (Type, error) {
+	if len(data) < 4 {
+		return nil, valueError(offset, "%s needs a 4 byte tag, %d left", typ.Name(), len(data))
+	}
+	tag := binary.BigEndian.Uint32(data[0:4])
+	if uint64(tag) >= uint64(len(typ.Members)) {
+		return nil, valueError(offset, "tag %d of %s has no member", tag, typ.Name())
+	}
+	return typ.Members[tag], nil
+}
+
+// Wrap Turns a payload of memberTyp into a payload of the union, tagged with the member that is the closest super
+// type of memberTyp
+func (typ TaggedUnionType) Wrap(memberTyp Type, data []byte) ([]byte, error) {
+	if !typ.Contains(memberTyp) {
+		return nil, errors.New("type is not a member of the union")
+	}
+	return Trim(memberTyp, typ, data)
+}
+
+// Contains Tells whether payloads of memberTyp can be wrapped into the union
+func (typ TaggedUnionType) Contains(memberTyp Type) bool {
+	return ClosestSuperType(memberTyp, typ.Members) >= 0
+}
@@ -0,0 +1,85 @@
+package types
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestTaggedUnion(t *testing.T) {
+	typ := TaggedUnionType{Members: []Type{Int32Type{}, StringType{}}}
+	deserialized, err := Deserialize(typ.Serialize())
+	if err != nil || !reflect.DeepEqual(deserialized, typ) {
+		t.Fatalf("Round trip failed: %v %v", deserialized, err)
+	}
+	if FixedSize(typ) || typ.Size() != 8 {
+		t.Error("Tagged union with members of different sizes must be variable-size")
+	}
+	if !FixedSize(TaggedUnionType{Members: []Type{Int32Type{}, Float32Type{}}}) {
+		t.Error("Tagged union with members of the same size must be fixed-size")
+	}
+
+	value, err := Decode(typ, []byte{0, 0, 0, 1, 0, 0, 0, 2, 'h', 'i'})
+	if err != nil || !reflect.DeepEqual(value, UnionValue{Member: 1, Value: "hi"}) {
+		t.Errorf("Wrong value %v %v", value, err)
+	}
+	for _, data := range [][]byte{
+		{0, 0, 0, 2, 0, 0, 0, 0},      // No member 2
+		{0, 0, 0, 0, 0, 0, 0, 0, 0},   // Longer than the Int32
+		{0, 0, 0, 1, 0, 0, 0, 5, 'h'}, // Shorter than the string
+		{0, 0, 0},                     // No tag
+	} {
+		if err := Validate(typ, data); err == nil {
+			t.Errorf("%v should be invalid", data)
+		}
+	}
+	encoded, err := Encode(typ, UnionValue{Member: 0, Value: int32(7)})
+	if err != nil || !bytes.Equal(encoded, []byte{0, 0, 0, 0, 0, 0, 0, 7}) {
+		t.Errorf("Wrong encoding %v %v", encoded, err)
+	}
+}
+
+func TestWrapIntoTaggedUnion(t *testing.T) {
+	point := StructType{Fields: []Type{Int32Type{}, Int32Type{}}}
+	union := TaggedUnionType{Members: []Type{CharType{}, point}}
+	point3D := StructType{Fields: []Type{Int32Type{}, Int32Type{}, Int32Type{}}}
+	if !union.Contains(point3D) || union.Contains(Int64Type{}) {
+		t.Error("Members and their subtypes should be contained, nothing else")
+	}
+	wrapped, err := Trim(point3D, union, []byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3})
+	if err != nil || !bytes.Equal(wrapped, []byte{0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 2}) {
+		t.Errorf("Wrong wrapping %v %v", wrapped, err)
+	}
+	if _, err := Trim(CharType{}, union, []byte{0}); err == nil {
+		t.Error("Short payload should not be wrapped")
+	}
+}
+
+func TestFixedSizeTaggedUnionBadTag(t *testing.T) {
+	typ := TaggedUnionType{Members: []Type{Int32Type{}, Float32Type{}}}
+	wider := TaggedUnionType{Members: []Type{Int32Type{}, Float32Type{}, CharType{}}}
+	badTag := []byte{0, 0, 0, 9, 0, 0, 0, 1}
+	if !FixedSize(typ) {
+		t.Fatal("Expected a fixed-size tagged union")
+	}
+	if err := Validate(typ, badTag); err == nil {
+		t.Error("Bad tag should not validate")
+	}
+	if _, err := Trim(typ, typ, badTag); err == nil {
+		t.Error("Bad tag should not be trimmed")
+	}
+	if _, err := Trim(typ, wider, badTag); err == nil {
+		t.Error("Bad tag should not be projected")
+	}
+	array := ArrayType{Length: 2, Typ: typ}
+	if _, err := Trim(array, array, append([]byte{0, 0, 0, 1, 0, 0, 0, 1}, badTag...)); err == nil {
+		t.Error("Bad tag in an array should not be trimmed")
+	}
+	strct := StructType{Fields: []Type{BoolType{}, typ}}
+	if err := Validate(strct, append([]byte{1}, badTag...)); err == nil {
+		t.Error("Bad tag in a struct should not validate")
+	}
+	if _, err := Deserialize(TaggedUnionType{}.Serialize()); err == nil {
+		t.Error("Tagged union without members should be rejected")
+	}
+}
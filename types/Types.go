@@ -4,8 +4,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"reflect"
-	"sync"
 )
 
 type Type interface {
@@ -14,22 +12,12 @@ type Type interface {
 	Size() uint64
 	Serialize() []byte
 	Deserialize([]byte) (Type, error)
-	// GetSuperTypes Gets all types that such that the current type is equal to or a subtype of
-	// Ordered from same type up to highest subtype
+	// GetSuperTypes Gets the type and its super types, ordered from the type itself upwards
+	//
+	// Deprecated: structs have exponentially many super types, use EachSuperType to enumerate them as needed.
 	GetSuperTypes() []Type
 }
 
-var typIdMap = createTypeIdMap()
-
-func createTypeIdMap() map[byte]Type {
-	idMap := map[byte]Type{}
-	types := []Type{CharType{}, Int32Type{}, Int64Type{}, Float32Type{}, Float64Type{}, BoolType{}, StructType{}, UnionType{}, ArrayType{}}
-	for _, typ := range types {
-		idMap[typ.typId()] = typ
-	}
-	return idMap
-}
-
 const (
 	charTypeId    = 0
 	int32TypeId   = 1
@@ -40,21 +28,16 @@ const (
 	structTypeId  = 6
 	unionTypeId   = 7
 	arrayTypeId   = 8
+	stringTypeId  = 9
+	bytesTypeId   = 10
+	listTypeId    = 11
+	// taggedUnionTypeId is laid out like unionTypeId
+	taggedUnionTypeId  = 12
+	namedStructTypeId  = 13
+	layoutStructTypeId = 14
+	cCharTypeId        = 15
 )
 
-func Deserialize(raw []byte) (Type, error) {
-	if len(raw) < 5 {
-		return nil, errors.New("too short")
-	}
-	typId := raw[4]
-	typ := typIdMap[typId]
-	desertyp, err := typ.Deserialize(raw)
-	if err != nil {
-		return nil, err
-	}
-	return desertyp, nil
-}
-
 type CharType struct {
 	Type
 }
@@ -62,18 +45,13 @@ type CharType struct {
 func (typ CharType) Name() string          { return "Char" }
 func (typ CharType) typId() byte           { return charTypeId }
 func (typ CharType) Size() uint64          { return 2 }
-func (typ CharType) GetSuperTypes() []Type { return []Type{typ} }
+func (typ CharType) GetSuperTypes() []Type { return superTypesOf(typ) }
 func (typ CharType) Serialize() []byte {
 	ser := make([]byte, 4)
 	binary.BigEndian.PutUint32(ser, 5)
 	return append(ser, typ.typId())
 }
-func (typ CharType) Deserialize(data []byte) (Type, error) {
-	if len(data) != 5 {
-		return typ, errors.New("invalid length")
-	}
-	return typ, nil
-}
+func (typ CharType) Deserialize(data []byte) (Type, error) { return deserializeAs(charTypeId, data) }
 
 type Int32Type struct {
 	Type
@@ -82,19 +60,14 @@ type Int32Type struct {
 func (typ Int32Type) Name() string          { return "Int32" }
 func (typ Int32Type) typId() byte           { return int32TypeId }
 func (typ Int32Type) Size() uint64          { return 4 }
-func (typ Int32Type) GetSuperTypes() []Type { return []Type{typ} }
+func (typ Int32Type) GetSuperTypes() []Type { return superTypesOf(typ) }
 func (typ Int32Type) Serialize() []byte {
 	ser := make([]byte, 4)
 	binary.BigEndian.PutUint32(ser, 5)
 
 	return append(ser, typ.typId())
 }
-func (typ Int32Type) Deserialize(data []byte) (Type, error) {
-	if len(data) != 5 {
-		return typ, errors.New("invalid length")
-	}
-	return typ, nil
-}
+func (typ Int32Type) Deserialize(data []byte) (Type, error) { return deserializeAs(int32TypeId, data) }
 
 type Int64Type struct {
 	Type
@@ -103,19 +76,14 @@ type Int64Type struct {
 func (typ Int64Type) Name() string          { return "Int64" }
 func (typ Int64Type) typId() byte           { return int64TypeId }
 func (typ Int64Type) Size() uint64          { return 8 }
-func (typ Int64Type) GetSuperTypes() []Type { return []Type{typ} }
+func (typ Int64Type) GetSuperTypes() []Type { return superTypesOf(typ) }
 func (typ Int64Type) Serialize() []byte {
 	ser := make([]byte, 4)
 	binary.BigEndian.PutUint32(ser, 5)
 
 	return append(ser, typ.typId())
 }
-func (typ Int64Type) Deserialize(data []byte) (Type, error) {
-	if len(data) != 5 {
-		return typ, errors.New("invalid length")
-	}
-	return typ, nil
-}
+func (typ Int64Type) Deserialize(data []byte) (Type, error) { return deserializeAs(int64TypeId, data) }
 
 type Float32Type struct {
 	Type
@@ -124,7 +92,7 @@ type Float32Type struct {
 func (typ Float32Type) Name() string          { return "Float32" }
 func (typ Float32Type) typId() byte           { return float32TypeId }
 func (typ Float32Type) Size() uint64          { return 4 }
-func (typ Float32Type) GetSuperTypes() []Type { return []Type{typ} }
+func (typ Float32Type) GetSuperTypes() []Type { return superTypesOf(typ) }
 func (typ Float32Type) Serialize() []byte {
 	ser := make([]byte, 4)
 	binary.BigEndian.PutUint32(ser, 5)
@@ -132,10 +100,7 @@ func (typ Float32Type) Serialize() []byte {
 	return append(ser, typ.typId())
 }
 func (typ Float32Type) Deserialize(data []byte) (Type, error) {
-	if len(data) != 5 {
-		return typ, errors.New("invalid length")
-	}
-	return typ, nil
+	return deserializeAs(float32TypeId, data)
 }
 
 type Float64Type struct {
@@ -145,7 +110,7 @@ type Float64Type struct {
 func (typ Float64Type) Name() string          { return "Float64" }
 func (typ Float64Type) typId() byte           { return float64TypeId }
 func (typ Float64Type) Size() uint64          { return 8 }
-func (typ Float64Type) GetSuperTypes() []Type { return []Type{typ} }
+func (typ Float64Type) GetSuperTypes() []Type { return superTypesOf(typ) }
 func (typ Float64Type) Serialize() []byte {
 	ser := make([]byte, 4)
 	binary.BigEndian.PutUint32(ser, 5)
@@ -153,10 +118,7 @@ func (typ Float64Type) Serialize() []byte {
 	return append(ser, typ.typId())
 }
 func (typ Float64Type) Deserialize(data []byte) (Type, error) {
-	if len(data) != 5 {
-		return typ, errors.New("invalid length")
-	}
-	return typ, nil
+	return deserializeAs(float64TypeId, data)
 }
 
 type BoolType struct {
@@ -166,93 +128,114 @@ type BoolType struct {
 func (typ BoolType) Name() string          { return "Bool" }
 func (typ BoolType) typId() byte           { return boolTypeId }
 func (typ BoolType) Size() uint64          { return 1 }
-func (typ BoolType) GetSuperTypes() []Type { return []Type{typ} }
+func (typ BoolType) GetSuperTypes() []Type { return superTypesOf(typ) }
 func (typ BoolType) Serialize() []byte {
 	ser := make([]byte, 4)
 	binary.BigEndian.PutUint32(ser, 5)
 	return append(ser, typ.typId())
 }
-func (typ BoolType) Deserialize(data []byte) (Type, error) {
-	if len(data) != 5 {
-		return typ, errors.New("invalid length")
-	}
-	return typ, nil
+func (typ BoolType) Deserialize(data []byte) (Type, error) { return deserializeAs(boolTypeId, data) }
+
+// CCharType is a single byte, C's char, where CharType is a UTF-16 code unit
+type CCharType struct {
+	Type
 }
 
+func (typ CCharType) Name() string          { return "CChar" }
+func (typ CCharType) typId() byte           { return cCharTypeId }
+func (typ CCharType) Size() uint64          { return 1 }
+func (typ CCharType) GetSuperTypes() []Type { return superTypesOf(typ) }
+func (typ CCharType) Serialize() []byte {
+	ser := make([]byte, 4)
+	binary.BigEndian.PutUint32(ser, 5)
+	return append(ser, typ.typId())
+}
+func (typ CCharType) Deserialize(data []byte) (Type, error) { return deserializeAs(cCharTypeId, data) }
+
 type StructType struct {
 	Type
 	Fields []Type
+	Names  []string // nil, or the unique name of each field
+	Layout Layout
 }
 
 func (typ StructType) Name() string {
 	name := "Struct"
-	for _, fieldTyp := range typ.Fields {
-		name += "-" + fieldTyp.Name()
+	if typ.Layout == CLayout {
+		name = "CStruct"
+	}
+	for i, fieldTyp := range typ.Fields {
+		name += "-"
+		if typ.named() {
+			name += typ.nameOf(i) + ":"
+		}
+		name += fieldTyp.Name()
 	}
 	return name
 }
 func (typ StructType) typId() byte {
+	if typ.Layout != PackedLayout {
+		return layoutStructTypeId
+	}
+	if typ.named() {
+		return namedStructTypeId
+	}
 	return structTypeId
 }
 func (typ StructType) Size() uint64 {
+	if typ.Layout == CLayout {
+		_, size, _ := typ.cLayout()
+		return size
+	}
 	size := uint64(0)
 	for _, fieldTyp := range typ.Fields {
 		size += fieldTyp.Size()
 	}
 	return size
 }
-func (typ StructType) IsSubtypeOf(superTyp StructType) bool {
-	if len(superTyp.Fields) >= len(typ.Fields) {
-		return false
-	}
-	for i, superField := range superTyp.Fields {
-		if !reflect.DeepEqual(typ.Fields[i], superField) {
-			return false
-		}
-	}
-	return true
-}
-
-var globalSuperTypeCache = createSuperTypeCache()
+func (typ StructType) GetSuperTypes() []Type { return superTypesOf(typ) }
 
-// GetSuperTypes Get all super types and the type itself
-func (typ StructType) GetSuperTypes() []Type {
-	if cachedSuperTypes := globalSuperTypeCache.get(typ); cachedSuperTypes != nil {
-		return cachedSuperTypes
-	}
-	noFields := len(typ.Fields)
-	superTypes := make([]Type, noFields)
-	for i := range typ.Fields {
-		superTypes[i] = StructType{
-			Fields: typ.Fields[:(noFields - i)],
-		}
-	}
-	go globalSuperTypeCache.put(typ, superTypes) // So we don't need to wait for write-back
-	return superTypes
+// IsSubtypeOf Tells whether typ is a proper subtype of superTyp
+func (typ StructType) IsSubtypeOf(superTyp StructType) bool {
+	return IsSubtype(typ, superTyp) && !Same(typ, superTyp)
 }
 
+// TrimToSuperType Checks that data is a payload of typ and projects it to a payload of superType, a proper super type
+//
+// Deprecated: use Trim, which also projects to typ itself and to types other than structs.
 func (typ StructType) TrimToSuperType(superType StructType, data []byte) ([]byte, error) {
-	if uint64(len(data)) != typ.Size() {
-		return nil, errors.New("invalid data length")
-	}
 	if !typ.IsSubtypeOf(superType) {
 		return nil, errors.New("not actually a subtype")
 	}
-	return data[:superType.Size()], nil
+	return Trim(typ, superType, data)
 }
 
+// Trim Checks that data is a payload of typ and projects it to a payload of superType
 func Trim(typ Type, superType Type, data []byte) ([]byte, error) {
-	if typ.Name() == superType.Name() {
-		return data, nil
+	return trim(typ, superType, data, false)
+}
+
+// TrimWidening Is Trim for IsWideningSubtype, widening numbers along the way
+func TrimWidening(typ Type, superType Type, data []byte) ([]byte, error) {
+	return trim(typ, superType, data, true)
+}
+
+func trim(typ Type, superType Type, data []byte, widen bool) ([]byte, error) {
+	if err := checkPayloadSize(typ, data); err != nil {
+		return nil, err
 	}
-	structType, isStruct := typ.(StructType)
-	superStructType, isSuperStruct := superType.(StructType)
-	if !isStruct || !isSuperStruct {
-		return nil, errors.New("subtyping only exists between structs")
+	if !isSubtype(typ, superType, widen) {
+		return nil, fmt.Errorf("%s is not a subtype of %s", typ.Name(), superType.Name())
 	}
-	return structType.TrimToSuperType(superStructType, data)
+	return project(typ, superType, data, widen)
 }
 func (typ StructType) Serialize() []byte {
+	if typ.Layout != PackedLayout {
+		return typ.serializeLaidOut()
+	}
+	if typ.named() {
+		return typ.serializeNamed()
+	}
 	serFields := make([]byte, 0)
 	length := uint32(9)
 	noFields := uint32(0)
@@ -271,35 +254,7 @@ func (typ StructType) Serialize() []byte {
 }
 
 func (typ StructType) Deserialize(data []byte) (Type, error) {
-	if len(data) < 8 {
-		return typ, errors.New("too short")
-	}
-	noFields := binary.BigEndian.Uint32(data[5:9])
-	startIdx := uint32(4 + 1 + 4)
-	var fields []Type
-	for i := uint32(0); i < noFields; i++ {
-		lenMaxIdx := startIdx + 4
-		typIdIdx := lenMaxIdx
-		if uint32(len(data)) < typIdIdx {
-			return typ, errors.New("too short")
-		}
-		fieldLen := binary.BigEndian.Uint32(data[startIdx:lenMaxIdx])
-		endIdx := startIdx + fieldLen
-		if uint32(len(data)) < endIdx {
-			return typ, errors.New("too short")
-		}
-		fieldArr := data[startIdx:endIdx]
-		fieldTypId := data[typIdIdx]
-		fieldTyp := typIdMap[fieldTypId]
-		fieldDeserTyp, err := fieldTyp.Deserialize(fieldArr)
-		if err != nil {
-			return typ, err
-		}
-		fields = append(fields, fieldDeserTyp)
-		startIdx = endIdx
-	}
-	typ.Fields = fields
-	return typ, nil
+	return deserializeAs(typ.typId(), data)
 }
 
 type UnionType struct {
@@ -326,7 +281,7 @@ func (typ UnionType) Size() uint64 {
 	}
 	return size
 }
-func (typ UnionType) GetSuperTypes() []Type { return []Type{typ} }
+func (typ UnionType) GetSuperTypes() []Type { return superTypesOf(typ) }
 func (typ UnionType) Serialize() []byte {
 	serFields := make([]byte, 0)
 	length := uint32(9)
@@ -346,35 +301,7 @@ func (typ UnionType) Serialize() []byte {
 }
 
 func (typ UnionType) Deserialize(data []byte) (Type, error) {
-	if len(data) < 8 {
-		return typ, errors.New("too short")
-	}
-	noFields := binary.BigEndian.Uint32(data[5:9])
-	startIdx := uint32(4 + 1 + 4)
-	var fields []Type
-	for i := uint32(0); i < noFields; i++ {
-		lenMaxIdx := startIdx + 4
-		typIdIdx := lenMaxIdx
-		if uint32(len(data)) < typIdIdx {
-			return typ, errors.New("too short")
-		}
-		fieldLen := binary.BigEndian.Uint32(data[startIdx:lenMaxIdx])
-		endIdx := startIdx + fieldLen
-		if uint32(len(data)) < endIdx {
-			return typ, errors.New("too short")
-		}
-		fieldArr := data[startIdx:endIdx]
-		fieldTypId := data[typIdIdx]
-		fieldTyp := typIdMap[fieldTypId]
-		fieldDeserTyp, err := fieldTyp.Deserialize(fieldArr)
-		if err != nil {
-			return typ, err
-		}
-		fields = append(fields, fieldDeserTyp)
-		startIdx = endIdx
-	}
-	typ.Members = fields
-	return typ, nil
+	return deserializeAs(unionTypeId, data)
 }
 
 type ArrayType struct {
@@ -392,7 +319,7 @@ func (typ ArrayType) typId() byte {
 func (typ ArrayType) Size() uint64 {
 	return typ.Length * typ.Typ.Size()
 }
-func (typ ArrayType) GetSuperTypes() []Type { return []Type{typ} }
+func (typ ArrayType) GetSuperTypes() []Type { return superTypesOf(typ) }
 func (typ ArrayType) Serialize() []byte {
 	typSer := typ.Typ.Serialize()
 	typSerLen := uint32(len(typSer))
@@ -406,42 +333,5 @@ func (typ ArrayType) Serialize() []byte {
 	return result
 }
 func (typ ArrayType) Deserialize(data []byte) (Type, error) {
-	nonForeignSize := 4 + 1 + 8
-	minLength := nonForeignSize + 4 + 1
-	if len(data) < minLength {
-		return typ, errors.New("too short")
-	}
-	lenRaw := data[5 : 5+8]
-	typ.Length = binary.BigEndian.Uint64(lenRaw)
-	innerTypId := data[minLength-1]
-	inner := typIdMap[innerTypId]
-	innerDeser, err := inner.Deserialize(data[nonForeignSize:])
-	if err != nil {
-		return typ, err
-	}
-	typ.Typ = innerDeser
-	return typ, nil
-}
-
-func createSuperTypeCache() superTypeCache {
-	return superTypeCache{
-		types:      map[string][]Type{},
-		writeMutex: &sync.Mutex{},
-	}
-}
-
-type superTypeCache struct {
-	types      map[string][]Type
-	writeMutex *sync.Mutex
-}
-
-func (cache *superTypeCache) get(typ Type) []Type {
-	return cache.types[typ.Name()]
-}
-func (cache *superTypeCache) put(typ Type, superTypes []Type) {
-	cache.writeMutex.Lock()
-	defer cache.writeMutex.Unlock()
-	if cache.get(typ) == nil {
-		cache.types[typ.Name()] = superTypes
-	}
+	return deserializeAs(arrayTypeId, data)
 }
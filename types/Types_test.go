@@ -360,3 +360,22 @@ func TestArrDeserNestedStruct(t *testing.T) {
 		return
 	}
 }
+
+func TestConcurrentGetSuperTypes(t *testing.T) {
+	typ := StructType{Fields: []Type{Int32Type{}, CharType{}, Float32Type{}}}
+	done := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func() {
+			ok := true
+			for j := 0; j < 1000; j++ {
+				ok = ok && len(typ.GetSuperTypes()) == 3
+			}
+			done <- ok
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		if !<-done {
+			t.Error("Wrong super types")
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"unicode/utf8"
+)
+
+// Payloads are decoded into value trees of these Go types:
+//   Char     rune, a Unicode code point of the basic multilingual plane that is not a surrogate
+//   Int32    int32
+//   Int64    int64
+//   Float32  float32
+//   Float64  float64
+//   Bool     bool
+//   CChar    byte
+//   String   string
+//   Bytes    []byte
+//   Struct   []interface{} holding a value per field, in the order of the fields whatever their layout
+//   Array    []interface{} holding a value per element
+//   List     []interface{} holding a value per element
+//   Union    UnionValue
+//   TaggedUnion UnionValue
+// All numbers are big-endian like the rest of the protocol, except in C layout structs, see CLayout.
+
+// UnionValue is the value of a union, interpreted as its Member-th member. Plain unions are untagged, so decoding
+// picks the first member the payload is valid for, tagged unions carry the member.
+type UnionValue struct {
+	Member int
+	Value  interface{}
+}
+
+// ValueError reports a payload that is not a valid value of its type, at which byte offset of the payload
+type ValueError struct {
+	Offset uint64
+	Reason string
+}
+
+func (e *ValueError) Error() string {
+	return fmt.Sprintf("invalid value at byte %d: %s", e.Offset, e.Reason)
+}
+
+func valueError(offset uint64, format string, args ...interface{}) *ValueError {
+	return &ValueError{Offset: offset, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Validate Checks that data is a valid payload of typ
+func Validate(typ Type, data []byte) error {
+	_, err := Decode(typ, data)
+	return err
+}
+
+// Decode Decodes and validates a payload of typ into a value tree
+func Decode(typ Type, data []byte) (interface{}, error) {
+	value, size, err := decodeValue(typ, data, 0)
+	if err != nil {
+		return nil, err
+	}
+	if size != uint64(len(data)) {
+		return nil, valueError(size, "%d bytes after the %s", uint64(len(data))-size, typ.Name())
+	}
+	return value, nil
+}
+
+// decodeValue Decodes the payload of typ that data starts with, returning its size
+func decodeValue(typ Type, data []byte, offset uint64) (interface{}, uint64, error) {
+	size, err := payloadSize(typ, data, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	data = data[:size]
+	switch typ := typ.(type) {
+	case CharType:
+		char := rune(binary.BigEndian.Uint16(data))
+		if char >= 0xD800 && char <= 0xDFFF {
+			return nil, 0, valueError(offset, "surrogate 0x%X is not a character", char)
+		}
+		return char, size, nil
+	case Int32Type:
+		return int32(binary.BigEndian.Uint32(data)), size, nil
+	case Int64Type:
+		return int64(binary.BigEndian.Uint64(data)), size, nil
+	case Float32Type:
+		return math.Float32frombits(binary.BigEndian.Uint32(data)), size, nil
+	case Float64Type:
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), size, nil
+	case BoolType:
+		if data[0] > 1 {
+			return nil, 0, valueError(offset, "bool must be 0 or 1, got %d", data[0])
+		}
+		return data[0] == 1, size, nil
+	case CCharType:
+		return data[0], size, nil
+	case StringType:
+		if !utf8.Valid(data[4:]) {
+			return nil, 0, valueError(offset, "string is not valid UTF-8")
+		}
+		return string(data[4:]), size, nil
+	case BytesType:
+		return append([]byte{}, data[4:]...), size, nil
+	case StructType:
+		if typ.Layout == CLayout {
+			packed, err := fromC(typ, data, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			values, err := decodeFieldValues(typ.packed(), packed, offset)
+			return values, size, err
+		}
+		values, err := decodeFieldValues(typ, data, offset)
+		return values, size, err
+	case ArrayType:
+		values, err := decodeElements(typ.Typ, typ.Length, data, offset)
+		return values, size, err
+	case ListType:
+		values, err := decodeElements(typ.Typ, uint64(binary.BigEndian.Uint32(data)), data[4:], offset+4)
+		return values, size, err
+	case TaggedUnionType:
+		tag := binary.BigEndian.Uint32(data) // Checked by payloadSize
+		value, _, err := decodeValue(typ.Members[tag], data[4:], offset+4)
+		if err != nil {
+			return nil, 0, err
+		}
+		return UnionValue{Member: int(tag), Value: value}, size, nil
+	case UnionType:
+		for i, member := range typ.Members {
+			if !allZero(data[member.Size():]) {
+				continue // Padding after a member must be zero
+			}
+			if value, _, err := decodeValue(member, data[:member.Size()], offset); err == nil {
+				return UnionValue{Member: i, Value: value}, size, nil
+			}
+		}
+		return nil, 0, valueError(offset, "payload does not fit any member of %s", typ.Name())
+	}
+	return nil, 0, valueError(offset, "cannot decode values of %s", typ.Name())
+}
+
+func decodeFieldValues(typ StructType, data []byte, offset uint64) ([]interface{}, error) {
+	spans, err := fieldSpans(typ, data)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(typ.Fields))
+	for i, field := range typ.Fields {
+		value, _, err := decodeValue(field, data[spans[i].start:spans[i].end], offset+spans[i].start)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func decodeElements(typ Type, count uint64, data []byte, offset uint64) ([]interface{}, error) {
+	if typ.Size() == 0 && count > MaxFields {
+		return nil, valueError(offset, "%d elements of size 0", count) // Would allocate without bound
+	}
+	values := make([]interface{}, count)
+	pos := uint64(0)
+	for i := range values {
+		value, size, err := decodeValue(typ, data[pos:], offset+pos)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+		pos += size
+	}
+	return values, nil
+}
+
+func allZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// maxEncodeCapacity Bounds the capacity allocated up front by Encode, the size of a type is not checked against
+// the value yet and may be huge
+const maxEncodeCapacity = 1 << 16
+
+// Encode Encodes a value tree as a payload of typ, the inverse of Decode
+func Encode(typ Type, value interface{}) ([]byte, error) {
+	capacity := typ.Size()
+	if capacity > maxEncodeCapacity {
+		capacity = maxEncodeCapacity
+	}
+	data := make([]byte, 0, capacity)
+	return encodeValue(typ, value, data)
+}
+
+func encodeValue(typ Type, value interface{}, data []byte) ([]byte, error) {
+	mismatch := func() ([]byte, error) {
+		return nil, fmt.Errorf("cannot encode %T as %s", value, typ.Name())
+	}
+	switch typ := typ.(type) {
+	case CharType:
+		char, ok := value.(rune)
+		if !ok {
+			return mismatch()
+		}
+		if char < 0 || char > 0xFFFF || (char >= 0xD800 && char <= 0xDFFF) {
+			return nil, fmt.Errorf("%U is not a single UTF-16 code unit", char)
+		}
+		return appendUint(data, uint64(char), 2), nil
+	case Int32Type:
+		i, ok := value.(int32)
+		if !ok {
+			return mismatch()
+		}
+		return appendUint(data, uint64(uint32(i)), 4), nil
+	case Int64Type:
+		i, ok := value.(int64)
+		if !ok {
+			return mismatch()
+		}
+		return appendUint(data, uint64(i), 8), nil
+	case Float32Type:
+		f, ok := value.(float32)
+		if !ok {
+			return mismatch()
+		}
+		return appendUint(data, uint64(math.Float32bits(f)), 4), nil
+	case Float64Type:
+		f, ok := value.(float64)
+		if !ok {
+			return mismatch()
+		}
+		return appendUint(data, math.Float64bits(f), 8), nil
+	case BoolType:
+		b, ok := value.(bool)
+		if !ok {
+			return mismatch()
+		}
+		if b {
+			return append(data, 1), nil
+		}
+		return append(data, 0), nil
+	case CCharType:
+		char, ok := value.(byte)
+		if !ok {
+			return mismatch()
+		}
+		return append(data, char), nil
+	case StringType:
+		str, ok := value.(string)
+		if !ok {
+			return mismatch()
+		}
+		if !utf8.ValidString(str) {
+			return nil, errors.New("string is not valid UTF-8")
+		}
+		return appendPrefixed(typ, data, uint64(len(str)), typ.MaxLength, []byte(str))
+	case BytesType:
+		raw, ok := value.([]byte)
+		if !ok {
+			return mismatch()
+		}
+		return appendPrefixed(typ, data, uint64(len(raw)), typ.MaxLength, raw)
+	case ListType:
+		values, ok := value.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		data, err := appendPrefixed(typ, data, uint64(len(values)), typ.MaxLength, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, elem := range values {
+			if data, err = encodeValue(typ.Typ, elem, data); err != nil {
+				return nil, err
+			}
+		}
+		return data, nil
+	case StructType:
+		values, ok := value.([]interface{})
+		if !ok || len(values) != len(typ.Fields) {
+			return mismatch()
+		}
+		fields := make([][]byte, len(typ.Fields))
+		for i, field := range typ.Fields {
+			var err error
+			if fields[i], err = encodeValue(field, values[i], nil); err != nil {
+				return nil, err
+			}
+		}
+		if typ.Layout == CLayout {
+			laidOut, err := toC(typ, assemble(fields))
+			if err != nil {
+				return nil, err
+			}
+			return append(data, laidOut...), nil
+		}
+		return append(data, assemble(fields)...), nil
+	case ArrayType:
+		values, ok := value.([]interface{})
+		if !ok || uint64(len(values)) != typ.Length {
+			return mismatch()
+		}
+		for _, elem := range values {
+			var err error
+			if data, err = encodeValue(typ.Typ, elem, data); err != nil {
+				return nil, err
+			}
+		}
+		return data, nil
+	case TaggedUnionType:
+		union, ok := value.(UnionValue)
+		if !ok || union.Member < 0 || union.Member >= len(typ.Members) {
+			return mismatch()
+		}
+		return encodeValue(typ.Members[union.Member], union.Value, appendUint(data, uint64(union.Member), 4))
+	case UnionType:
+		union, ok := value.(UnionValue)
+		if !ok || union.Member < 0 || union.Member >= len(typ.Members) {
+			return mismatch()
+		}
+		start := len(data)
+		data, err := encodeValue(typ.Members[union.Member], union.Value, data)
+		if err != nil {
+			return nil, err
+		}
+		return append(data, make([]byte, typ.Size()-uint64(len(data)-start))...), nil
+	}
+	return mismatch()
+}
+
+// appendPrefixed Appends the length prefix of a string, byte string or list followed by raw
+func appendPrefixed(typ Type, data []byte, length uint64, maxLength uint32, raw []byte) ([]byte, error) {
+	if length > math.MaxUint32 || (maxLength != 0 && length > uint64(maxLength)) {
+		return nil, fmt.Errorf("length %d exceeds the maximum of %s", length, typ.Name())
+	}
+	return append(appendUint(data, length, 4), raw...), nil
+}
+
+func appendUint(data []byte, value uint64, size int) []byte {
+	raw := make([]byte, 8)
+	binary.BigEndian.PutUint64(raw, value)
+	return append(data, raw[8-size:]...)
+}
@@ -0,0 +1,80 @@
+package types
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestValueRoundTrip(t *testing.T) {
+	typ := StructType{Fields: []Type{
+		CharType{},
+		BoolType{},
+		ArrayType{Length: 2, Typ: Int32Type{}},
+		UnionType{Members: []Type{BoolType{}, Float64Type{}}},
+		Int64Type{},
+		Float32Type{},
+		CCharType{},
+	}}
+	value := []interface{}{
+		'ü',
+		true,
+		[]interface{}{int32(-1), int32(7)},
+		UnionValue{Member: 1, Value: 2.5},
+		int64(1) << 40,
+		float32(0.5),
+		byte('c'),
+	}
+	data, err := Encode(typ, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(len(data)) != typ.Size() {
+		t.Fatalf("Encoded %d bytes for a type of size %d", len(data), typ.Size())
+	}
+	decoded, err := Decode(typ, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reencoded, err := Encode(typ, decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, reencoded) {
+		t.Errorf("Round trip changed %v to %v", data, reencoded)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	union := UnionType{Members: []Type{BoolType{}, CharType{}}}
+	cases := []struct {
+		typ   Type
+		data  []byte
+		valid bool
+	}{
+		{BoolType{}, []byte{1}, true},
+		{BoolType{}, []byte{2}, false},
+		{CharType{}, []byte{0, 'a'}, true},
+		{CharType{}, []byte{0xD8, 0x00}, false},
+		{Int32Type{}, []byte{1, 2, 3}, false},
+		{union, []byte{1, 0}, true},
+		{union, []byte{0xDC, 0x00}, false},
+		{StructType{Fields: []Type{Int32Type{}, BoolType{}}}, []byte{0xFF, 0xFF, 0xFF, 0xFF, 3}, false},
+	}
+	for _, c := range cases {
+		err := Validate(c.typ, c.data)
+		var valueErr *ValueError
+		if c.valid && err != nil {
+			t.Errorf("%v should be a valid %s: %v", c.data, c.typ.Name(), err)
+		} else if !c.valid && !errors.As(err, &valueErr) {
+			t.Errorf("%v should not be a valid %s", c.data, c.typ.Name())
+		}
+	}
+}
+
+func TestEncodeHugeArray(t *testing.T) {
+	typ := ArrayType{Length: 1 << 60, Typ: Int64Type{}}
+	if _, err := Encode(typ, []interface{}{int64(1)}); err == nil {
+		t.Error("Expected a value shorter than the array to be rejected")
+	}
+}
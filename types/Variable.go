@@ -0,0 +1,222 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Variable-size types have payloads that start with a 4 byte big-endian length: the number of bytes for strings
+// and byte strings, the number of elements for lists. A struct or array containing them is variable-size as well,
+// its payload being the concatenation of its fields' or elements' payloads. Unions must have fixed-size members.
+// The Size() of a variable-size type is the smallest size its payloads can have.
+
+// StringType is UTF-8 text of at most MaxLength bytes, 0 meaning unbounded
+type StringType struct {
+	Type
+	MaxLength uint32
+}
+
+func (typ StringType) Name() string          { return boundedName("String", typ.MaxLength) }
+func (typ StringType) typId() byte           { return stringTypeId }
+func (typ StringType) Size() uint64          { return 4 }
+func (typ StringType) GetSuperTypes() []Type { return superTypesOf(typ) }
+func (typ StringType) Serialize() []byte     { return serializeBounded(stringTypeId, typ.MaxLength) }
+func (typ StringType) Deserialize(data []byte) (Type, error) {
+	return deserializeAs(stringTypeId, data)
+}
+
+// BytesType is an opaque byte string of at most MaxLength bytes, 0 meaning unbounded
+type BytesType struct {
+	Type
+	MaxLength uint32
+}
+
+func (typ BytesType) Name() string          { return boundedName("Bytes", typ.MaxLength) }
+func (typ BytesType) typId() byte           { return bytesTypeId }
+func (typ BytesType) Size() uint64          { return 4 }
+func (typ BytesType) GetSuperTypes() []Type { return superTypesOf(typ) }
+func (typ BytesType) Serialize() []byte     { return serializeBounded(bytesTypeId, typ.MaxLength) }
+func (typ BytesType) Deserialize(data []byte) (Type, error) {
+	return deserializeAs(bytesTypeId, data)
+}
+
+// ListType holds at most MaxLength elements of Typ, 0 meaning unbounded
+type ListType struct {
+	Type
+	MaxLength uint32
+	Typ       Type
+}
+
+func (typ ListType) Name() string          { return boundedName("List-"+typ.Typ.Name(), typ.MaxLength) }
+func (typ ListType) typId() byte           { return listTypeId }
+func (typ ListType) Size() uint64          { return 4 }
+func (typ ListType) GetSuperTypes() []Type { return superTypesOf(typ) }
+func (typ ListType) Serialize() []byte {
+	ser := append(serializeBounded(listTypeId, typ.MaxLength), typ.Typ.Serialize()...)
+	binary.BigEndian.PutUint32(ser[0:4], uint32(len(ser)))
+	return ser
+}
+func (typ ListType) Deserialize(data []byte) (Type, error) {
+	return deserializeAs(listTypeId, data)
+}
+
+func boundedName(name string, maxLength uint32) string {
+	if maxLength == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s-%d", name, maxLength)
+}
+
+// serializeBounded Serializes the length, id and max length of a string, byte string or list
+func serializeBounded(typId byte, maxLength uint32) []byte {
+	ser := make([]byte, 9)
+	binary.BigEndian.PutUint32(ser[0:4], 9)
+	ser[4] = typId
+	binary.BigEndian.PutUint32(ser[5:9], maxLength)
+	return ser
+}
+
+// FixedSize Tells whether all payloads of typ have Size() bytes
+func FixedSize(typ Type) bool {
+	switch typ := typ.(type) {
+	case StringType, BytesType, ListType:
+		return false
+	case StructType:
+		for _, field := range typ.Fields {
+			if !FixedSize(field) {
+				return false
+			}
+		}
+	case ArrayType:
+		return typ.Length == 0 || FixedSize(typ.Typ)
+	case TaggedUnionType:
+		return typ.fixedSize()
+	}
+	return true
+}
+
+// hasTag Tells whether payloads of typ hold the tag of a tagged union, which has to be checked even if typ is
+// fixed-size
+func hasTag(typ Type) bool {
+	switch typ := typ.(type) {
+	case TaggedUnionType:
+		return true
+	case StructType:
+		for _, field := range typ.Fields {
+			if hasTag(field) {
+				return true
+			}
+		}
+	case ArrayType:
+		return typ.Length != 0 && hasTag(typ.Typ)
+	}
+	return false
+}
+
+// PayloadSize Returns the size of the payload of typ that data starts with, checking its length prefixes against
+// data and the max lengths of typ
+func PayloadSize(typ Type, data []byte) (uint64, error) {
+	return payloadSize(typ, data, 0)
+}
+
+func payloadSize(typ Type, data []byte, offset uint64) (uint64, error) {
+	if FixedSize(typ) && !hasTag(typ) {
+		if typ.Size() > uint64(len(data)) {
+			return 0, valueError(offset, "%s needs %d bytes, %d left", typ.Name(), typ.Size(), len(data))
+		}
+		return typ.Size(), nil
+	}
+	switch typ := typ.(type) {
+	case StringType, BytesType:
+		length, err := readLength(typ, data, offset)
+		if err != nil {
+			return 0, err
+		}
+		if uint64(length) > uint64(len(data)-4) {
+			return 0, valueError(offset, "%d bytes declared, %d left", length, len(data)-4)
+		}
+		return 4 + uint64(length), nil
+	case ListType:
+		count, err := readLength(typ, data, offset)
+		if err != nil {
+			return 0, err
+		}
+		size, err := elementsSize(typ.Typ, uint64(count), data[4:], offset+4)
+		return 4 + size, err
+	case StructType:
+		pos := uint64(0)
+		for _, field := range typ.Fields {
+			size, err := payloadSize(field, data[pos:], offset+pos)
+			if err != nil {
+				return 0, err
+			}
+			pos += size
+		}
+		return pos, nil
+	case ArrayType:
+		return elementsSize(typ.Typ, typ.Length, data, offset)
+	case TaggedUnionType:
+		member, err := typ.member(data, offset)
+		if err != nil {
+			return 0, err
+		}
+		size, err := payloadSize(member, data[4:], offset+4)
+		return 4 + size, err
+	}
+	return 0, valueError(offset, "cannot measure payloads of %s", typ.Name())
+}
+
+// readLength Reads the length prefix of a string, byte string or list and checks it against the max length
+func readLength(typ Type, data []byte, offset uint64) (uint32, error) {
+	if len(data) < 4 {
+		return 0, valueError(offset, "%s needs a 4 byte length, %d left", typ.Name(), len(data))
+	}
+	length := binary.BigEndian.Uint32(data[0:4])
+	var maxLength uint32
+	switch typ := typ.(type) {
+	case StringType:
+		maxLength = typ.MaxLength
+	case BytesType:
+		maxLength = typ.MaxLength
+	case ListType:
+		maxLength = typ.MaxLength
+	}
+	if maxLength != 0 && length > maxLength {
+		return 0, valueError(offset, "length %d exceeds the maximum of %s", length, typ.Name())
+	}
+	return length, nil
+}
+
+func elementsSize(elemTyp Type, count uint64, data []byte, offset uint64) (uint64, error) {
+	if FixedSize(elemTyp) {
+		elemSize := elemTyp.Size()
+		if elemSize != 0 && count > uint64(len(data))/elemSize {
+			return 0, valueError(offset, "%d elements of %s do not fit in %d bytes", count, elemTyp.Name(), len(data))
+		}
+		if !hasTag(elemTyp) {
+			return count * elemSize, nil
+		}
+	}
+	pos := uint64(0)
+	for i := uint64(0); i < count; i++ { // Variable-size elements take at least 4 bytes, bounding the iterations
+		size, err := payloadSize(elemTyp, data[pos:], offset+pos)
+		if err != nil {
+			return 0, err
+		}
+		pos += size
+	}
+	return pos, nil
+}
+
+// checkPayloadSize Checks that data is exactly one payload of typ
+func checkPayloadSize(typ Type, data []byte) error {
+	size, err := PayloadSize(typ, data)
+	if err != nil {
+		return err
+	}
+	if size != uint64(len(data)) {
+		return errors.New("invalid data length")
+	}
+	return nil
+}
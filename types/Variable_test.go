@@ -0,0 +1,106 @@
+package types
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVariableTypesSerialize(t *testing.T) {
+	for _, typ := range []Type{
+		StringType{},
+		BytesType{MaxLength: 16},
+		ListType{MaxLength: 3, Typ: StructType{Fields: []Type{StringType{}, Int32Type{}}}},
+	} {
+		deserialized, err := Deserialize(typ.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !Same(deserialized, typ) {
+			t.Errorf("%s deserialized as %s", typ.Name(), deserialized.Name())
+		}
+	}
+	union := UnionType{Members: []Type{Int32Type{}, StringType{}}}
+	if _, err := Deserialize(union.Serialize()); err == nil {
+		t.Error("Unions of variable-size members should be rejected")
+	}
+}
+
+func TestPayloadSize(t *testing.T) {
+	typ := StructType{Fields: []Type{StringType{MaxLength: 5}, ListType{Typ: BytesType{}}, BoolType{}}}
+	payload := []byte{
+		0, 0, 0, 2, 'h', 'i',
+		0, 0, 0, 2, 0, 0, 0, 1, 'x', 0, 0, 0, 0,
+		1,
+	}
+	if size, err := PayloadSize(typ, append(payload, 9, 9)); err != nil || size != uint64(len(payload)) {
+		t.Errorf("Expected a size of %d, got %d (%v)", len(payload), size, err)
+	}
+	if _, err := PayloadSize(typ, payload[:len(payload)-1]); err == nil {
+		t.Error("Truncated payload should be rejected")
+	}
+	tooLong := append([]byte{0, 0, 0, 6}, "sixsix"...)
+	if _, err := PayloadSize(StringType{MaxLength: 5}, tooLong); err == nil {
+		t.Error("String longer than its max length should be rejected")
+	}
+	if _, err := PayloadSize(ListType{Typ: StringType{}}, []byte{0xFF, 0xFF, 0xFF, 0xFF}); err == nil {
+		t.Error("List claiming more elements than there are bytes should be rejected")
+	}
+}
+
+func TestTrimVariableStruct(t *testing.T) {
+	super := StructType{Fields: []Type{StringType{}}}
+	typ := StructType{Fields: []Type{StringType{}, Int32Type{}}}
+	payload := []byte{0, 0, 0, 3, 'a', 'b', 'c', 0, 0, 0, 7}
+	trimmed, err := Trim(typ, super, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(trimmed, payload[:7]) {
+		t.Errorf("Expected just the string, got %v", trimmed)
+	}
+	if _, err := Trim(typ, super, payload[:10]); err == nil {
+		t.Error("Payload of the wrong size should be rejected")
+	}
+}
+
+func TestVariableValues(t *testing.T) {
+	typ := StructType{Fields: []Type{StringType{}, BytesType{}, ListType{Typ: Int32Type{}}}}
+	value := []interface{}{"grüße", []byte{1, 2}, []interface{}{int32(1), int32(2), int32(3)}}
+	data, err := Encode(typ, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Decode(typ, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.([]interface{})[0] != "grüße" || len(decoded.([]interface{})[2].([]interface{})) != 3 {
+		t.Errorf("Wrong value %v", decoded)
+	}
+	if err := Validate(StringType{}, []byte{0, 0, 0, 1, 0xFF}); err == nil {
+		t.Error("Invalid UTF-8 should be rejected")
+	}
+}
+
+func FuzzDecodeValue(f *testing.F) {
+	typ := StructType{Fields: []Type{
+		StringType{MaxLength: 64},
+		ListType{Typ: StructType{Fields: []Type{BytesType{}, BoolType{}}}},
+		ArrayType{Length: 2, Typ: UnionType{Members: []Type{CharType{}, Int32Type{}}}},
+	}}
+	seed, _ := Encode(typ, []interface{}{
+		"seed",
+		[]interface{}{[]interface{}{[]byte{1}, true}},
+		[]interface{}{UnionValue{Member: 0, Value: 'a'}, UnionValue{Member: 1, Value: int32(-1)}},
+	})
+	f.Add(seed)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		value, err := Decode(typ, data)
+		if err != nil {
+			return
+		}
+		if _, err := Encode(typ, value); err != nil {
+			t.Errorf("Decoded value does not encode: %v", err)
+		}
+	})
+}